@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -18,21 +19,24 @@ func findhtdocs(t *testing.T) string {
 	return htdocsdir
 }
 
-func launchgohttpd(t *testing.T) *http.Server {
+func launchgohttpd(t *testing.T) (*http.Server, string) {
 	htdocs := findhtdocs(t)
 	s := &http.Server{
-		Addr:    ":8080",
 		Handler: http.FileServer(http.Dir(htdocs)),
 	}
-	t.Logf("Launching web server on http://localhost:8080/")
-	go s.ListenAndServe()
-	return s
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v\n", err.Error())
+	}
+	t.Logf("Launching web server on http://%v/", ln.Addr())
+	go s.Serve(ln)
+	return s, ln.Addr().String()
 }
 
 func TestGet1(t *testing.T) {
-	s := launchgohttpd(t)
+	s, addr := launchgohttpd(t)
 
-	resp, err := http.Get("http://localhost:8080/index.html")
+	resp, err := http.Get("http://" + addr + "/index.html")
 	if err != nil {
 		t.Fatalf("Error issuing request: %v\n", err.Error())
 	}
@@ -46,9 +50,9 @@ func TestGet1(t *testing.T) {
 }
 
 func TestGet2(t *testing.T) {
-	s := launchgohttpd(t)
+	s, addr := launchgohttpd(t)
 
-	resp, err := http.Get("http://localhost:8080/cat.html")
+	resp, err := http.Get("http://" + addr + "/cat.html")
 	if err != nil {
 		t.Fatalf("Error issuing request: %v\n", err.Error())
 	}
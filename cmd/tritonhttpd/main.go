@@ -1,47 +1,468 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
 	"cse224/tritonhttp"
+
+	"gopkg.in/yaml.v2"
 )
 
+// envPrefix starts the name of the environment variable of each flag,
+// e.g. TRITONHTTPD_PORT for -port.
+const envPrefix = "TRITONHTTPD_"
+
+// options are the settings of tritonhttpd: the server section of the config
+// file, the file itself, and what to do with them.
+type options struct {
+	server       tritonhttp.ServerConfig
+	vhConfigPath string
+	check        bool
+	printConfig  bool
+}
+
 func main() {
-	currDir, err := os.Getwd()
+	opts, err := parseOptions(flag.CommandLine, os.Args[1:], os.LookupEnv)
 	if err != nil {
-		log.Fatalf("Could not get current working directory: %v", err)
+		log.Fatal(err)
 	}
-	defaultVhConfigPath := filepath.Join(currDir, "virtual_hosts.yaml")
-	defaultDocroot := filepath.Join(currDir, "docroot_dirs")
+	cfg := opts.server
 
-	// Parse command line flags
-	var port = flag.Int("port", 8080, "the localhost port to listen on")
-	var vhConfigPath = flag.String("vh_config", defaultVhConfigPath, "path to the virtual hosting config file")
-	var docrootDirsPath = flag.String("docroot", defaultDocroot, "path to the directory that contains all docroot dirs")
-	flag.Parse()
+	logger, err := newLogger(cfg.Log.Level, cfg.Log.Format)
+	if err != nil {
+		log.Fatalf("Invalid logging settings: %v", err)
+	}
+	slog.SetDefault(logger)
+
+	if opts.check {
+		if err := checkConfig(opts.vhConfigPath, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%v: configuration OK\n", opts.vhConfigPath)
+		return
+	}
+	if opts.printConfig {
+		if err := printConfig(os.Stdout, opts.vhConfigPath, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
 
 	// Log server configs
-	fmt.Println()
-	log.Print("Server configs:")
-	log.Printf("  port: %v", *port)
-	log.Printf("  path to virtual hosts config file: %v", *vhConfigPath)
-	log.Printf("  path to docroot directories: %v", *docrootDirsPath)
-	fmt.Println()
+	logger.Info("Server configs",
+		"addr", cfg.ListenAddr(),
+		"tlsAddr", cfg.TLSListenAddr(),
+		"redirectHTTPS", cfg.RedirectHTTPS,
+		"vhConfig", opts.vhConfigPath,
+		"docroot", cfg.Docroot,
+		"watchVHConfig", cfg.WatchInterval,
+		"readTimeout", cfg.Timeouts.Read,
+		"readHeaderTimeout", cfg.Timeouts.ReadHeader,
+		"writeTimeout", cfg.Timeouts.Write,
+		"idleTimeout", cfg.Timeouts.Idle,
+		"shutdownTimeout", cfg.Timeouts.Shutdown,
+		"maxBodyBytes", cfg.Limits.MaxBodyBytes,
+		"accessLog", cfg.Log.AccessLog,
+		"accessLogFormat", cfg.Log.AccessLogFormat,
+		"metricsAddr", cfg.MetricsAddr,
+	)
 
-	virtualHosts := tritonhttp.ParseVHConfigFile(*vhConfigPath, *docrootDirsPath)
+	virtualHosts := tritonhttp.ParseVHConfigFile(opts.vhConfigPath, cfg.Docroot)
 
 	// Start server
-	addr := fmt.Sprintf(":%v", *port)
+	addr := cfg.ListenAddr()
 
-	log.Printf("Starting TritonHTTP server")
-	log.Printf("You can browse the website at http://localhost:%v/", *port)
+	logger.Info("Starting TritonHTTP server", "url", listenURL("http", addr))
 	s := &tritonhttp.Server{
-		Addr:         addr,
-		VirtualHosts: virtualHosts,
+		Addr:                 addr,
+		VirtualHosts:         virtualHosts,
+		ReadTimeout:          cfg.Timeouts.Read,
+		ReadHeaderTimeout:    cfg.Timeouts.ReadHeader,
+		WriteTimeout:         cfg.Timeouts.Write,
+		IdleTimeout:          cfg.Timeouts.Idle,
+		MaxBodyBytes:         cfg.Limits.MaxBodyBytes,
+		RejectEncodedSlashes: cfg.Limits.RejectEncodedSlashes,
+		Logger:               logger,
+	}
+	if tlsAddr := cfg.TLSListenAddr(); tlsAddr != "" {
+		s.TLSAddr = tlsAddr
+		s.RedirectToHTTPS = cfg.RedirectHTTPS
+	}
+
+	var accessLog *tritonhttp.AccessLog
+	if cfg.Log.AccessLog != "" {
+		accessLog, err = tritonhttp.OpenAccessLog(cfg.Log.AccessLog, cfg.Log.AccessLogFormat)
+		if err != nil {
+			log.Fatalf("Failed to open access log: %v", err)
+		}
+		accessLog.MaxSize = cfg.Log.AccessLogMaxSize
+		accessLog.MaxBackups = cfg.Log.AccessLogMaxBackups
+		accessLog.Logger = logger
+		s.AccessLog = accessLog
+	}
+
+	// Swap in a new virtual hosting config, keeping the old one if invalid
+	reload := func() {
+		virtualHosts, err := tritonhttp.LoadVHConfigFile(opts.vhConfigPath, cfg.Docroot)
+		if err == nil {
+			err = s.SetVirtualHosts(virtualHosts)
+		}
+		if err != nil {
+			logger.Error("Keeping the current virtual hosts, new config is invalid", "path", opts.vhConfigPath, "err", err)
+			return
+		}
+		logger.Info("Reloaded virtual hosts", "path", opts.vhConfigPath, "count", len(virtualHosts))
+	}
+
+	// On SIGHUP reload the config and reopen the access log, after
+	// logrotate has moved it
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload()
+			if accessLog != nil {
+				logger.Info("Reopening access log", "path", cfg.Log.AccessLog)
+				if err := accessLog.Reopen(); err != nil {
+					logger.Error("Failed to reopen access log", "path", cfg.Log.AccessLog, "err", err)
+				}
+			}
+		}
+	}()
+	if cfg.WatchInterval > 0 {
+		go watchFile(context.Background(), opts.vhConfigPath, cfg.WatchInterval, reload)
+	}
+
+	// Serve metrics on a separate admin listener, away from the virtual hosts
+	var admin *tritonhttp.Server
+	if cfg.MetricsAddr != "" {
+		metrics := tritonhttp.NewMetrics()
+		s.Metrics = metrics
+		admin = &tritonhttp.Server{
+			Addr:    cfg.MetricsAddr,
+			Handler: metrics,
+			Logger:  logger.With("server", "metrics"),
+		}
+		go func() {
+			if err := admin.ListenAndServe(); !errors.Is(err, tritonhttp.ErrServerClosed) {
+				log.Fatalf("Failed to serve metrics: %v", err)
+			}
+		}()
+		logger.Info("Serving metrics", "url", fmt.Sprintf("http://%v%v", cfg.MetricsAddr, tritonhttp.MetricsPath))
+	}
+
+	// Shut down gracefully on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 2)
+	listeners := 1
+	go func() {
+		errc <- s.ListenAndServe()
+	}()
+	if s.TLSAddr != "" {
+		listeners++
+		logger.Info("Serving HTTPS", "url", listenURL("https", s.TLSAddr))
+		go func() {
+			errc <- s.ListenAndServeTLS()
+		}()
+	}
+
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case <-ctx.Done():
+		stop()
+	}
+
+	logger.Info("Shutting down, waiting for open connections", "timeout", cfg.Timeouts.Shutdown)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
+	defer cancel()
+
+	// Finish the cleanup even if the shutdown is not clean, and only then
+	// report it in the exit status
+	clean := true
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		logger.Error("Failed to shut down gracefully", "err", err)
+		clean = false
+	}
+	if admin != nil {
+		if err := admin.Shutdown(shutdownCtx); err != nil {
+			logger.Error("Failed to shut down the metrics server gracefully", "err", err)
+			clean = false
+		}
+	}
+	for ; listeners > 0; listeners-- {
+		if err := <-errc; !errors.Is(err, tritonhttp.ErrServerClosed) {
+			logger.Error("Server failed", "err", err)
+			clean = false
+		}
+	}
+	if accessLog != nil {
+		if err := accessLog.Close(); err != nil {
+			logger.Error("Failed to close access log", "path", cfg.Log.AccessLog, "err", err)
+			clean = false
+		}
+	}
+	if !clean {
+		os.Exit(1)
+	}
+	logger.Info("Server stopped")
+}
+
+// parseOptions parses the command line args with fs and builds the
+// effective server config. Each setting comes from, in order of precedence,
+// its flag, its environment variable (looked up by lookupEnv), the server
+// section of the config file, or its default.
+func parseOptions(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) (options, error) {
+	currDir, err := os.Getwd()
+	if err != nil {
+		return options{}, fmt.Errorf("could not get current working directory: %w", err)
+	}
+
+	opts := options{
+		vhConfigPath: filepath.Join(currDir, "virtual_hosts.yaml"),
+		server: tritonhttp.ServerConfig{
+			Port:    8080,
+			Docroot: filepath.Join(currDir, "docroot_dirs"),
+			Timeouts: tritonhttp.TimeoutConfig{
+				Read:       tritonhttp.READ_TIMEOUT,
+				ReadHeader: tritonhttp.READ_HEADER_TIMEOUT,
+				Shutdown:   10 * time.Second,
+			},
+			Log: tritonhttp.LogConfig{
+				Level:               "info",
+				Format:              "text",
+				AccessLogFormat:     tritonhttp.LogFormatCombined,
+				AccessLogMaxBackups: 5,
+			},
+		},
+	}
+	cfg := &opts.server
+
+	fs.StringVar(&opts.vhConfigPath, "vh_config", opts.vhConfigPath, "path to the config file, with the server settings and the virtual hosts")
+	fs.IntVar(&cfg.Port, "port", cfg.Port, "the port to listen on, on every interface")
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "the host:port address to listen on, e.g. 127.0.0.1:8080, instead of port")
+	fs.StringVar(&cfg.Docroot, "docroot", cfg.Docroot, "path to the directory that contains all docroot dirs")
+	fs.IntVar(&cfg.TLSPort, "tls_port", cfg.TLSPort, "the port to listen on for HTTPS with the certificates of the virtual hosts, or 0 to disable HTTPS")
+	fs.StringVar(&cfg.TLSAddr, "tls_addr", cfg.TLSAddr, "the host:port address to listen on for HTTPS, instead of tls_port")
+	fs.BoolVar(&cfg.RedirectHTTPS, "redirect_https", cfg.RedirectHTTPS, "redirect every plaintext request to HTTPS")
+	fs.DurationVar(&cfg.WatchInterval, "watch_vh_config", cfg.WatchInterval, "how often to check the config file for changes and reload the virtual hosts, or 0 to reload only on SIGHUP")
+	fs.DurationVar(&cfg.Timeouts.Read, "read_timeout", cfg.Timeouts.Read, "how long to wait for each byte of a request")
+	fs.DurationVar(&cfg.Timeouts.ReadHeader, "read_header_timeout", cfg.Timeouts.ReadHeader, "how long to wait for the request line and headers as a whole")
+	fs.DurationVar(&cfg.Timeouts.Write, "write_timeout", cfg.Timeouts.Write, "how long writing a response may take, or 0 for no limit")
+	fs.DurationVar(&cfg.Timeouts.Idle, "idle_timeout", cfg.Timeouts.Idle, "how long to keep an idle connection open, advertised in the Keep-Alive header, or 0 to use read_timeout")
+	fs.DurationVar(&cfg.Timeouts.Shutdown, "shutdown_timeout", cfg.Timeouts.Shutdown, "how long to wait for open connections on shutdown")
+	fs.Int64Var(&cfg.Limits.MaxBodyBytes, "max_body_bytes", cfg.Limits.MaxBodyBytes, "largest request body accepted, or 0 for no limit")
+	fs.BoolVar(&cfg.Limits.RejectEncodedSlashes, "reject_encoded_slashes", cfg.Limits.RejectEncodedSlashes, "answer requests whose path contains %2F with 400")
+	fs.StringVar(&cfg.Log.AccessLog, "access_log", cfg.Log.AccessLog, "path to the access log, or - for stdout; reopened on SIGHUP")
+	fs.StringVar((*string)(&cfg.Log.AccessLogFormat), "access_log_format", string(cfg.Log.AccessLogFormat), "access log format: common, combined or json")
+	fs.Int64Var(&cfg.Log.AccessLogMaxSize, "access_log_max_size", cfg.Log.AccessLogMaxSize, "size in bytes at which the access log is rotated, or 0 to never rotate")
+	fs.IntVar(&cfg.Log.AccessLogMaxBackups, "access_log_max_backups", cfg.Log.AccessLogMaxBackups, "number of rotated access logs to keep")
+	fs.StringVar(&cfg.Log.Level, "log_level", cfg.Log.Level, "minimum level of server logs: debug, info, warn or error")
+	fs.StringVar(&cfg.Log.Format, "log_format", cfg.Log.Format, "format of server logs: text or json")
+	fs.StringVar(&cfg.MetricsAddr, "metrics_addr", cfg.MetricsAddr, "admin address, e.g. localhost:9090, on which to serve Prometheus metrics at /metrics; empty disables metrics")
+	fs.BoolVar(&opts.check, "check", false, "validate the config file and flags, then exit without serving")
+	fs.BoolVar(&opts.printConfig, "print-config", false, "print the effective config, after flags and environment variables, as a config file, then exit")
+	if err := fs.Parse(args); err != nil {
+		return options{}, err
+	}
+
+	// Remember the flags given on the command line, which the config file
+	// is about to overwrite
+	cmdline := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		cmdline[f.Name] = f.Value.String()
+	})
+	if _, ok := cmdline["vh_config"]; !ok {
+		if path, ok := lookupEnv(envVar("vh_config")); ok {
+			opts.vhConfigPath = path
+		}
+	}
+
+	if err := tritonhttp.LoadServerConfig(opts.vhConfigPath, cfg); err != nil {
+		return options{}, err
+	}
+
+	// Then layer the environment and the command line over the file
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := cmdline[f.Name]
+		source := "-" + f.Name
+		if !ok {
+			// The environment holds settings, not what to do with them
+			if f.Name == "check" || f.Name == "print-config" {
+				return
+			}
+			source = envVar(f.Name)
+			if value, ok = lookupEnv(source); !ok {
+				return
+			}
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for %v: %w", value, source, err))
+		}
+	})
+	return opts, errors.Join(errs...)
+}
+
+// listenURL returns the URL of the root of a server listening on addr, for
+// the logs.
+func listenURL(scheme string, addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Sprintf("%v://%v/", scheme, addr)
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%v://%v/", scheme, net.JoinHostPort(host, port))
+}
+
+// envVar returns the name of the environment variable of a flag.
+func envVar(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// checkConfig validates the effective server config and the virtual hosts
+// of the config file, reporting every problem at once.
+func checkConfig(vhConfigPath string, cfg tritonhttp.ServerConfig) error {
+	serverErr := cfg.Validate()
+	virtualHosts, err := tritonhttp.LoadVHConfigFile(vhConfigPath, cfg.Docroot)
+	if err != nil || serverErr != nil {
+		return errors.Join(serverErr, err)
+	}
+
+	if cfg.TLSListenAddr() != "" {
+		hasCert := false
+		for _, vhost := range virtualHosts {
+			hasCert = hasCert || vhost.CertFile != ""
+		}
+		if !hasCert {
+			return fmt.Errorf("HTTPS is enabled but no virtual host in %v has a certFile", vhConfigPath)
+		}
+	}
+	return nil
+}
+
+// printConfig writes the effective config to w as YAML, in the format of the
+// config file: the server settings followed by the virtual hosts, sorted by
+// host name. This is the resolved configuration rather than the file as
+// written: paths are absolute, except docRoots, which stay relative to
+// docroot, so the output loads as the same configuration wherever it is
+// saved.
+func printConfig(w io.Writer, vhConfigPath string, cfg tritonhttp.ServerConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	virtualHosts, err := tritonhttp.LoadVHConfigFile(vhConfigPath, cfg.Docroot)
+	if err != nil {
+		return err
+	}
+
+	// LoadVHConfigFile joined each docRoot to docroot; undo that, so that
+	// loading the output joins them again
+	for hostName, vhost := range virtualHosts {
+		if vhost.DocRoot, err = filepath.Rel(cfg.Docroot, vhost.DocRoot); err != nil {
+			return err
+		}
+		for _, path := range []*string{&vhost.CertFile, &vhost.KeyFile} {
+			if *path != "" {
+				if *path, err = filepath.Abs(*path); err != nil {
+					return err
+				}
+			}
+		}
+		virtualHosts[hostName] = vhost
+	}
+	if cfg.Docroot, err = filepath.Abs(cfg.Docroot); err != nil {
+		return err
+	}
+	if cfg.Log.AccessLog != "" && cfg.Log.AccessLog != "-" {
+		if cfg.Log.AccessLog, err = filepath.Abs(cfg.Log.AccessLog); err != nil {
+			return err
+		}
+	}
+
+	config := tritonhttp.VHConfigs{Server: cfg}
+	hostNames := make([]string, 0, len(virtualHosts))
+	for hostName := range virtualHosts {
+		hostNames = append(hostNames, hostName)
+	}
+	sort.Strings(hostNames)
+	for _, hostName := range hostNames {
+		config.VirtualHosts = append(config.VirtualHosts, virtualHosts[hostName])
+	}
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "# Effective configuration of %v. docRoots are relative to docroot, other paths absolute.\n", vhConfigPath)
+	_, err = w.Write(out)
+	return err
+}
+
+// watchFile calls changed whenever the size or modification time of the
+// file at path changes, checking every interval until ctx is done.
+func watchFile(ctx context.Context, path string, interval time.Duration, changed func()) {
+	stat := func() (int64, time.Time) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return -1, time.Time{}
+		}
+		return info.Size(), info.ModTime()
+	}
+
+	size, modTime := stat()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		newSize, newModTime := stat()
+		if newSize != size || !newModTime.Equal(modTime) {
+			size, modTime = newSize, newModTime
+			changed()
+		}
+	}
+}
+
+// newLogger returns a logger writing to stderr at the given minimum level,
+// as text or as JSON lines.
+func newLogger(level string, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
 	}
-	log.Fatal(s.ListenAndServe())
+	return nil, fmt.Errorf("unknown log format %q", format)
 }
@@ -3,17 +3,28 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"cse224/tritonhttp"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -45,45 +56,85 @@ func findhtdocs(t *testing.T) string {
 	return htdocsdir
 }
 
-func launchhttpd(t *testing.T) {
+// launchhttpd starts a server on an ephemeral port for the duration of the
+// test and returns the host and port it is listening on.
+func launchhttpd(t *testing.T) (string, string) {
+	var addr net.Addr
 	switch *usehttpd {
 	case "tritonhttp":
-		launchtritonhttpd(t)
+		addr = launchtritonhttpd(t)
 	case "go":
-		launchgohttpd(t)
+		addr = launchgohttpd(t)
 	default:
 		t.Fatalf("Invalid server type %v (must be 'tritonhttp' or 'go')", *usehttpd)
 	}
+
+	host, port, err := net.SplitHostPort(addr.String())
+	require.NoError(t, err, "Error parsing listen address")
+	return host, port
 }
 
-func launchgohttpd(t *testing.T) {
+func launchgohttpd(t *testing.T) net.Addr {
 	htdocs := findhtdocs(t)
 	s := &http.Server{
-		Addr:    ":8080",
 		Handler: http.FileServer(http.Dir(htdocs)),
 	}
-	go s.ListenAndServe()
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err, "Error listening")
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr()
 }
 
-func launchtritonhttpd(t *testing.T) {
-	cwd, err := os.Getwd()
-	if err != nil {
-		log.Fatal(err)
-	}
-	log.Println(cwd)
-	t.Log(cwd)
+func launchtritonhttpd(t *testing.T) net.Addr {
 	virtualHosts := tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")
 	s := &tritonhttp.Server{
-		Addr:         ":8080",
+		Addr:         "localhost:0",
 		VirtualHosts: virtualHosts,
 	}
-	go s.ListenAndServe()
+	return servetritonhttpd(t, s)
 }
 
-func TestGoFetch1(t *testing.T) {
-	launchhttpd(t)
+// servetritonhttpd serves s on a listener bound to s.Addr until the test ends.
+func servetritonhttpd(t *testing.T, s *tritonhttp.Server) net.Addr {
+	ln, err := s.Listen()
+	require.NoError(t, err, "Error listening")
+	go s.Serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return ln.Addr()
+}
+
+// fetchFrom sends a request with the given method, Host header and target,
+// followed by the extra header lines in headers, each ending in CRLF, to the
+// server listening on addr and returns the response and its body.
+func fetchFrom(t *testing.T, addr string, method string, hostHeader string, target string, headers string) (*http.Response, []byte) {
+	host, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err, "Error parsing listen address")
+
+	req := method + " " + target + " HTTP/1.1\r\n" +
+		"Host: " + hostHeader + "\r\n" +
+		headers +
+		"Connection: close\r\n" +
+		"\r\n"
+
+	respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+	require.NoError(t, err, ErrSendingRequest)
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), &http.Request{Method: method})
+	require.NoError(t, err, ErrParsingResponse)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err, "Error reading response body")
+	resp.Body.Close()
+	return resp, body
+}
 
-	time.Sleep(1 * time.Second)
+func TestGoFetch1(t *testing.T) {
+	t.Parallel()
+	host, port := launchhttpd(t)
 
 	req := "GET / HTTP/1.1\r\n" +
 		"Host: website1\r\n" +
@@ -91,7 +142,7 @@ func TestGoFetch1(t *testing.T) {
 		"User-Agent: gotest\r\n" +
 		"\r\n"
 
-	respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
+	respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
 	require.NoError(t, err, ErrSendingRequest)
 
 	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
@@ -109,9 +160,8 @@ func TestGoFetch1(t *testing.T) {
 }
 
 func TestGoFetch2(t *testing.T) {
-	launchhttpd(t)
-
-	time.Sleep(1 * time.Second)
+	t.Parallel()
+	host, port := launchhttpd(t)
 
 	req := "GET / HTTP/1.1\r\n" +
 		"Host: website1\r\n" +
@@ -123,7 +173,7 @@ func TestGoFetch2(t *testing.T) {
 		"Connection: close\r\n" +
 		"\r\n"
 
-	respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
+	respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
 	require.NoError(t, err, ErrSendingRequest)
 
 	respreader := bufio.NewReader(bytes.NewReader(respbytes))
@@ -152,9 +202,8 @@ func TestGoFetch2(t *testing.T) {
 }
 
 func TestGoFetch3(t *testing.T) {
-	launchhttpd(t)
-
-	time.Sleep(1 * time.Second)
+	t.Parallel()
+	host, port := launchhttpd(t)
 
 	req := "foobar\r\n" +
 		"Host: website1\r\n" +
@@ -162,7 +211,7 @@ func TestGoFetch3(t *testing.T) {
 		"User-Agent: gotest\r\n" +
 		"\r\n"
 
-	respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
+	respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
 	require.NoError(t, err, ErrSendingRequest)
 
 	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
@@ -176,13 +225,14 @@ func TestGoFetch3(t *testing.T) {
 }
 
 func TestConcurrentRequests(t *testing.T) {
-	launchhttpd(t)
+	t.Parallel()
+	host, port := launchhttpd(t)
 
 	var wg sync.WaitGroup
 	requestFunc := func() {
 		defer wg.Done()
 		req := "GET / HTTP/1.1\r\nHost: website1\r\n\r\n"
-		respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
+		respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
 		assert.NoError(t, err, ErrSendingRequest)
 		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
 		assert.NoError(t, err, ErrParsingResponse)
@@ -199,7 +249,8 @@ func TestConcurrentRequests(t *testing.T) {
 }
 
 func TestSuccessfulResponseHeaders(t *testing.T) {
-	launchhttpd(t)
+	t.Parallel()
+	host, port := launchhttpd(t)
 
 	req := "GET / HTTP/1.1\r\n" +
 		"Host: website3\r\n" +
@@ -207,7 +258,7 @@ func TestSuccessfulResponseHeaders(t *testing.T) {
 		"User-Agent: gotest\r\n" +
 		"\r\n"
 
-	respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
+	respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
 	require.NoError(t, err, ErrSendingRequest)
 
 	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
@@ -223,13 +274,14 @@ func TestSuccessfulResponseHeaders(t *testing.T) {
 }
 
 func TestRealPathTraversalAttack(t *testing.T) {
-	launchhttpd(t)
+	t.Parallel()
+	host, port := launchhttpd(t)
 
 	req := "GET /../htdocs2/ HTTP/1.1\r\n" +
 		"Host: website1\r\n" +
 		"\r\n"
 
-	respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
+	respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
 	require.NoError(t, err, ErrSendingRequest)
 
 	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
@@ -240,14 +292,618 @@ func TestRealPathTraversalAttack(t *testing.T) {
 	resp.Body.Close()
 }
 
+func TestEncodedPathTraversalAttack(t *testing.T) {
+	t.Parallel()
+	host, port := launchhttpd(t)
+
+	for _, target := range []string{
+		"/..%2fhtdocs2/index.html",
+		"/..%2Fhtdocs2/index.html",
+		"/%2e%2e/htdocs2/index.html",
+		"/%2e%2e%2fhtdocs2%2findex.html",
+		"/..%5chtdocs2%5cindex.html",
+	} {
+		t.Run(target, func(t *testing.T) {
+			req := "GET " + target + " HTTP/1.1\r\n" +
+				"Host: website1\r\n" +
+				"Connection: close\r\n" +
+				"\r\n"
+
+			respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+			require.NoError(t, err, ErrSendingRequest)
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			require.NoError(t, err, ErrParsingResponse)
+			resp.Body.Close()
+
+			assert.Equal(t, 404, resp.StatusCode, ErrStatusMsg)
+		})
+	}
+}
+
+func TestRequestTargetDecoding(t *testing.T) {
+	t.Parallel()
+
+	docRoot := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(docRoot, "a"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(docRoot, "index.html"), []byte("index"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(docRoot, "my file.html"), []byte("spaces"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(docRoot, "a", "b.txt"), []byte("nested"), 0644))
+
+	virtualHosts := map[string]tritonhttp.VirtualHost{
+		"site": {DocRoot: docRoot},
+	}
+	lenient := servetritonhttpd(t, &tritonhttp.Server{Addr: "localhost:0", VirtualHosts: virtualHosts})
+	strict := servetritonhttpd(t, &tritonhttp.Server{Addr: "localhost:0", VirtualHosts: virtualHosts, RejectEncodedSlashes: true})
+
+	tests := []struct {
+		name           string
+		addr           net.Addr
+		host           string
+		target         string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"Encoded Space", lenient, "site", "/my%20file.html", 200, "spaces"},
+		{"Query String", lenient, "site", "/index.html?v=3", 200, "index"},
+		{"Query String On Directory", lenient, "site", "/?v=3&w", 200, "index"},
+		{"Encoded Question Mark", lenient, "site", "/index.html%3Fv=3", 404, ""},
+		{"Encoded Path And Query", lenient, "site", "/my%20file.html?next=%2Fa%20b", 200, "spaces"},
+		{"Encoded Slash Allowed", lenient, "site", "/a%2Fb.txt", 200, "nested"},
+		{"Encoded Slash Rejected", strict, "site", "/a%2fb.txt", 400, ""},
+		{"Plain Slash With Strict Server", strict, "site", "/a/b.txt?x=%2F", 200, "nested"},
+		{"Encoded NUL", lenient, "site", "/index.html%00.txt", 400, ""},
+		{"Invalid Escape", lenient, "site", "/index%zz.html", 400, ""},
+		{"Absolute Form", lenient, "other", "http://site/index.html", 200, "index"},
+		{"Absolute Form With Port And Query", lenient, "site", "http://site:8080/my%20file.html?v=3", 200, "spaces"},
+		{"Absolute Form Empty Path", lenient, "site", "http://site", 200, "index"},
+		{"Absolute Form Overrides Host", lenient, "site", "http://other/index.html", 404, ""},
+		{"Absolute Form Unknown Scheme", lenient, "site", "ftp://site/index.html", 400, ""},
+		{"Absolute Form With Userinfo", lenient, "site", "http://user@site/index.html", 400, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := fetchFrom(t, tt.addr.String(), "GET", tt.host, tt.target, "")
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode, "Test %s: %s", tt.name, ErrStatusMsg)
+			if tt.expectedStatus == 200 {
+				assert.Equal(t, tt.expectedBody, string(body), "Test %s: Response body mismatch", tt.name)
+			}
+		})
+	}
+}
+
+func TestSiblingDocRootPrefix(t *testing.T) {
+	t.Parallel()
+
+	// "site0" starts with "site" but is not inside it
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "site"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "site0"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "site", "index.html"), []byte("public"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "site0", "secret.txt"), []byte("secret"), 0644))
+
+	s := &tritonhttp.Server{
+		Addr: "localhost:0",
+		VirtualHosts: map[string]tritonhttp.VirtualHost{
+			"site": {DocRoot: filepath.Join(dir, "site")},
+		},
+	}
+	addr := servetritonhttpd(t, s)
+
+	resp, body := fetchFrom(t, addr.String(), "GET", "site", "/index.html", "")
+	assert.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+	assert.Equal(t, "public", string(body))
+
+	resp, body = fetchFrom(t, addr.String(), "GET", "site", "/../site0/secret.txt", "")
+	assert.Equal(t, 404, resp.StatusCode, ErrStatusMsg)
+	assert.NotContains(t, string(body), "secret")
+}
+
+func TestSymlinkPolicy(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	docRoot := filepath.Join(dir, "site")
+	require.NoError(t, os.MkdirAll(filepath.Join(docRoot, "realdir"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "outside"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(docRoot, "real.txt"), []byte("real"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(docRoot, "realdir", "file.txt"), []byte("nested"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "outside", "secret.txt"), []byte("secret"), 0644))
+	require.NoError(t, os.Symlink("real.txt", filepath.Join(docRoot, "inside.txt")))
+	require.NoError(t, os.Symlink("realdir", filepath.Join(docRoot, "linkdir")))
+	require.NoError(t, os.Symlink("../outside/secret.txt", filepath.Join(docRoot, "outside.txt")))
+	require.NoError(t, os.Symlink("../outside", filepath.Join(docRoot, "outsidedir")))
+
+	s := &tritonhttp.Server{
+		Addr: "localhost:0",
+		VirtualHosts: map[string]tritonhttp.VirtualHost{
+			"follow": {DocRoot: docRoot, Symlinks: tritonhttp.SymlinksFollow},
+			"owner":  {DocRoot: docRoot, Symlinks: tritonhttp.SymlinksIfOwnerMatch},
+			"deny":   {DocRoot: docRoot, Symlinks: tritonhttp.SymlinksDeny},
+		},
+	}
+	addr := servetritonhttpd(t, s)
+
+	tests := []struct {
+		host           string
+		target         string
+		expectedStatus int
+	}{
+		{"follow", "/real.txt", 200},
+		{"follow", "/inside.txt", 200},
+		{"follow", "/linkdir/file.txt", 200},
+		{"follow", "/outside.txt", 404},
+		{"follow", "/outsidedir/secret.txt", 404},
+		{"owner", "/inside.txt", 200},
+		{"owner", "/linkdir/file.txt", 200},
+		{"owner", "/outside.txt", 404},
+		{"deny", "/real.txt", 200},
+		{"deny", "/realdir/file.txt", 200},
+		{"deny", "/inside.txt", 404},
+		{"deny", "/linkdir/file.txt", 404},
+		{"deny", "/outside.txt", 404},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host+tt.target, func(t *testing.T) {
+			resp, body := fetchFrom(t, addr.String(), "GET", tt.host, tt.target, "")
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode, ErrStatusMsg)
+			assert.NotContains(t, string(body), "secret")
+		})
+	}
+
+	t.Run("owner mismatch", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("changing the owner of a symlink requires root")
+		}
+		link := filepath.Join(docRoot, "foreign.txt")
+		require.NoError(t, os.Symlink("real.txt", link))
+		require.NoError(t, os.Lchown(link, 12345, 12345))
+
+		resp, _ := fetchFrom(t, addr.String(), "GET", "owner", "/foreign.txt", "")
+		assert.Equal(t, 404, resp.StatusCode, ErrStatusMsg)
+		resp, _ = fetchFrom(t, addr.String(), "GET", "follow", "/foreign.txt", "")
+		assert.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+	})
+}
+
+func TestDirectoryListing(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	docRoot := filepath.Join(dir, "site")
+	for _, d := range []string{"sub", "withindex", "empty"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(docRoot, d), 0755))
+	}
+	files := map[string]string{
+		"b.txt":                "bravo",
+		"a.txt":                "alpha!",
+		"my file#1.txt":        "escaped",
+		".secret":              "dotfile",
+		"notes.bak":            "backup",
+		"sub/nested.txt":       "nested",
+		"withindex/index.html": "<p>index</p>",
+		"../outside.txt":       "outside",
+	}
+	for name, data := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(docRoot, name), []byte(data), 0644))
+	}
+	require.NoError(t, os.Symlink("../outside.txt", filepath.Join(docRoot, "outside-link.txt")))
+
+	s := &tritonhttp.Server{
+		Addr: "localhost:0",
+		VirtualHosts: map[string]tritonhttp.VirtualHost{
+			"list": {DocRoot: docRoot, AutoIndex: tritonhttp.AutoIndexConfig{Enabled: true, HideDotfiles: true, Hide: []string{"*.bak"}}},
+			"all":  {DocRoot: docRoot, AutoIndex: tritonhttp.AutoIndexConfig{Enabled: true}},
+			"off":  {DocRoot: docRoot},
+		},
+	}
+	addr := servetritonhttpd(t, s).String()
+
+	type entry struct {
+		Name    string    `json:"name"`
+		IsDir   bool      `json:"isDir"`
+		Size    int64     `json:"size"`
+		ModTime time.Time `json:"modTime"`
+	}
+	listJSON := func(t *testing.T, vhost, target, accept string) []entry {
+		resp, body := fetchFrom(t, addr, "GET", vhost, target, "Accept: "+accept+"\r\n")
+		require.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+		require.Equal(t, "application/json", resp.Header.Get("Content-Type"), "Content-Type mismatch")
+		var listing struct {
+			Path    string  `json:"path"`
+			Entries []entry `json:"entries"`
+		}
+		require.NoError(t, json.Unmarshal(body, &listing), "Error decoding listing")
+		assert.Equal(t, target, listing.Path, "Listing path mismatch")
+		return listing.Entries
+	}
+	names := func(entries []entry) []string {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		return names
+	}
+
+	t.Run("HTML", func(t *testing.T) {
+		resp, body := fetchFrom(t, addr, "GET", "list", "/", "")
+		assert.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"), "Content-Type mismatch")
+		assert.Equal(t, "Accept", resp.Header.Get("Vary"), "Vary mismatch")
+		assert.Equal(t, int64(len(body)), resp.ContentLength, "Content-Length mismatch")
+
+		html := string(body)
+		assert.Contains(t, html, "Index of /")
+		assert.NotContains(t, html, `href="../"`, "The docroot has no parent link")
+		assert.Contains(t, html, `href="my%20file%231.txt"`, "Names should be escaped in links")
+		assert.Contains(t, html, `href="sub/"`, "Directories should link with a trailing slash")
+		assert.NotContains(t, html, ".secret")
+		assert.NotContains(t, html, "notes.bak")
+		assert.NotContains(t, html, "outside-link.txt", "Links leaving the docroot should not be listed")
+
+		a, b := strings.Index(html, "a.txt"), strings.Index(html, "b.txt")
+		assert.True(t, a >= 0 && b > a, "Entries should be sorted by name")
+	})
+
+	t.Run("Parent Link", func(t *testing.T) {
+		_, body := fetchFrom(t, addr, "GET", "list", "/sub/", "")
+		assert.Contains(t, string(body), `href="../"`)
+		assert.Contains(t, string(body), `href="nested.txt"`)
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		entries := listJSON(t, "list", "/", "application/json")
+		assert.Equal(t, []string{"a.txt", "b.txt", "empty", "my file#1.txt", "sub", "withindex"}, names(entries))
+		for _, e := range entries {
+			switch e.Name {
+			case "a.txt":
+				assert.False(t, e.IsDir)
+				assert.Equal(t, int64(len(files["a.txt"])), e.Size, "Size mismatch")
+				assert.WithinDuration(t, time.Now(), e.ModTime, time.Minute, "Modification time mismatch")
+			case "sub":
+				assert.True(t, e.IsDir)
+			}
+		}
+	})
+
+	t.Run("JSON Preferred By Q-Value", func(t *testing.T) {
+		entries := listJSON(t, "list", "/sub/", "text/html;q=0.5, application/json")
+		assert.Equal(t, []string{"nested.txt"}, names(entries))
+	})
+
+	t.Run("Empty Directory", func(t *testing.T) {
+		assert.Empty(t, listJSON(t, "list", "/empty/", "application/json"))
+	})
+
+	t.Run("Nothing Hidden", func(t *testing.T) {
+		entries := listJSON(t, "all", "/", "application/json")
+		assert.Contains(t, names(entries), ".secret")
+		assert.Contains(t, names(entries), "notes.bak")
+	})
+
+	t.Run("Wildcard Accept Gets HTML", func(t *testing.T) {
+		resp, _ := fetchFrom(t, addr, "GET", "list", "/", "Accept: */*\r\n")
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"), "Content-Type mismatch")
+	})
+
+	t.Run("Head", func(t *testing.T) {
+		get, getBody := fetchFrom(t, addr, "GET", "list", "/", "")
+		head, headBody := fetchFrom(t, addr, "HEAD", "list", "/", "")
+		assert.Equal(t, 200, head.StatusCode, ErrStatusMsg)
+		assert.Empty(t, headBody, "HEAD response should have no body")
+		assert.Equal(t, strconv.Itoa(len(getBody)), head.Header.Get("Content-Length"), "Content-Length mismatch")
+		assert.Equal(t, get.Header.Get("Content-Type"), head.Header.Get("Content-Type"), "Content-Type mismatch")
+	})
+
+	statusTests := []struct {
+		name           string
+		vhost          string
+		target         string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"Index File Wins", "list", "/withindex/", 200, files["withindex/index.html"]},
+		{"Listings Disabled", "off", "/", 404, ""},
+		{"Index File Without Listings", "off", "/withindex/", 200, files["withindex/index.html"]},
+		{"File With Trailing Slash", "list", "/a.txt/", 404, ""},
+		{"Hidden File Still Served", "list", "/.secret", 200, files[".secret"]},
+	}
+	for _, tt := range statusTests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := fetchFrom(t, addr, "GET", tt.vhost, tt.target, "")
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode, "Test %s: %s", tt.name, ErrStatusMsg)
+			if tt.expectedStatus == 200 {
+				assert.Equal(t, tt.expectedBody, string(body), "Test %s: body mismatch", tt.name)
+			}
+		})
+	}
+}
+
+func TestDirectoryRedirectsAndIndexFiles(t *testing.T) {
+	t.Parallel()
+
+	docRoot := t.TempDir()
+	files := map[string]string{
+		"index.html":              "root index",
+		"sub/index.html":          "sub index",
+		"my dir/index.html":       "spaced index",
+		"both/index.html":         "html",
+		"both/default.html":       "default",
+		"htm/index.htm":           "htm",
+		"htm/default.html":        "default",
+		"dirindex/index.html/a":   "not an index",
+		"dirindex/default.html":   "default after directory",
+		"none/readme.txt":         "no index here",
+		"sub/nested/default.html": "nested default",
+	}
+	for name, data := range files {
+		p := filepath.Join(docRoot, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(data), 0644))
+	}
+
+	s := &tritonhttp.Server{
+		Addr: "localhost:0",
+		VirtualHosts: map[string]tritonhttp.VirtualHost{
+			"default": {DocRoot: docRoot},
+			"custom":  {DocRoot: docRoot, IndexFiles: []string{"index.htm", "default.html"}},
+		},
+	}
+	host, port, err := net.SplitHostPort(servetritonhttpd(t, s).String())
+	require.NoError(t, err, "Error parsing listen address")
+
+	tests := []struct {
+		name             string
+		method           string
+		vhost            string
+		target           string
+		expectedStatus   int
+		expectedLocation string
+		expectedBody     string
+	}{
+		{"Redirect", "GET", "default", "/sub", 301, "/sub/", ""},
+		{"Redirect Nested", "GET", "default", "/sub/nested", 301, "/sub/nested/", ""},
+		{"Redirect Keeps Query", "GET", "default", "/sub?page=2", 301, "/sub/?page=2", ""},
+		{"Redirect Keeps Encoding", "GET", "default", "/my%20dir", 301, "/my%20dir/", ""},
+		{"Redirect Stays On Host", "GET", "default", "//sub", 301, "/sub/", ""},
+		{"Redirect Absolute Form", "GET", "default", "http://default/sub", 301, "/sub/", ""},
+		{"Redirect Head", "HEAD", "default", "/sub", 301, "/sub/", ""},
+		{"Default Index", "GET", "default", "/", 200, "", "root index"},
+		{"Default Index In Subdirectory", "GET", "default", "/sub/", 200, "", "sub index"},
+		{"Encoded Directory", "GET", "default", "/my%20dir/", 200, "", "spaced index"},
+		{"Default Ignores Other Names", "GET", "default", "/htm/", 404, "", ""},
+		{"Custom Order", "GET", "custom", "/htm/", 200, "", "htm"},
+		{"Custom Fallback", "GET", "custom", "/both/", 200, "", "default"},
+		{"Directory Named Like Index", "GET", "custom", "/sub/nested/", 200, "", "nested default"},
+		{"Custom Skips Unlisted Index", "GET", "custom", "/sub/", 404, "", ""},
+		{"No Index File", "GET", "default", "/none/", 404, "", ""},
+		{"Index Is A Directory", "GET", "default", "/dirindex/", 404, "", ""},
+		{"Index Directory Skipped", "GET", "custom", "/dirindex/", 200, "", "default after directory"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.method + " " + tt.target + " HTTP/1.1\r\n" +
+				"Host: " + tt.vhost + "\r\n" +
+				"Connection: close\r\n" +
+				"\r\n"
+
+			respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+			require.NoError(t, err, ErrSendingRequest)
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), &http.Request{Method: tt.method})
+			require.NoError(t, err, ErrParsingResponse)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err, "Error reading response body")
+			resp.Body.Close()
+
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode, "Test %s: %s", tt.name, ErrStatusMsg)
+			assert.Equal(t, tt.expectedLocation, resp.Header.Get("Location"), "Test %s: Location mismatch", tt.name)
+			if tt.expectedStatus == 200 {
+				assert.Equal(t, tt.expectedBody, string(body), "Test %s: body mismatch", tt.name)
+			}
+			if tt.expectedStatus == 301 {
+				assert.Empty(t, body, "Test %s: redirect should have no body", tt.name)
+			}
+		})
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	docRoot := filepath.Join(dir, "site")
+	files := map[string]string{
+		"site/index.html":      "home",
+		"site/errors/404.html": "<h1>Custom not found</h1>\n",
+		"site/errors/400.txt":  "custom bad request\n",
+		"site/errors/413.html": "<h1>Too big</h1>\n",
+		"outside.html":         "outside the docroot",
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(data), 0644))
+	}
+
+	s := &tritonhttp.Server{
+		Addr: "localhost:0",
+		VirtualHosts: map[string]tritonhttp.VirtualHost{
+			"custom": {DocRoot: docRoot, ErrorPages: map[int]string{
+				400: "/errors/400.txt",
+				404: "/errors/404.html",
+				405: "/errors/missing.html",
+				413: "/errors/413.html",
+				416: "/../outside.html",
+			}},
+			"plain": {DocRoot: docRoot},
+		},
+		MaxBodyBytes:         16,
+		RejectEncodedSlashes: true,
+	}
+	host, port, err := net.SplitHostPort(servetritonhttpd(t, s).String())
+	require.NoError(t, err, "Error parsing listen address")
+
+	builtinHTML := func(status string) string {
+		return "<!DOCTYPE html>\n<html>\n<head><title>" + status + "</title></head>\n<body>\n<h1>" + status + "</h1>\n</body>\n</html>\n"
+	}
+
+	tests := []struct {
+		name           string
+		request        string
+		method         string
+		expectedStatus int
+		expectedType   string
+		expectedBody   string
+	}{
+		{"Custom Page", "GET /nope HTTP/1.1\r\nHost: custom\r\n", "GET", 404, "text/html; charset=utf-8", files["site/errors/404.html"]},
+		{"Custom Page Head", "HEAD /nope HTTP/1.1\r\nHost: custom\r\n", "HEAD", 404, "text/html; charset=utf-8", ""},
+		{"Custom Plain Text Page", "GET /a%2Fb HTTP/1.1\r\nHost: custom\r\n", "GET", 400, "text/plain; charset=utf-8", files["site/errors/400.txt"]},
+		{"Custom Page Before Handler", "POST / HTTP/1.1\r\nHost: custom\r\nContent-Length: 17\r\n\r\n" + strings.Repeat("x", 17), "POST", 413, "text/html; charset=utf-8", files["site/errors/413.html"]},
+		{"Missing Page Falls Back", "DELETE / HTTP/1.1\r\nHost: custom\r\n", "DELETE", 405, "text/html; charset=utf-8", builtinHTML("405 Method Not Allowed")},
+		{"Page Outside Docroot Falls Back", "GET /index.html HTTP/1.1\r\nHost: custom\r\nRange: bytes=100-\r\n", "GET", 416, "text/html; charset=utf-8", builtinHTML("416 Range Not Satisfiable")},
+		{"Built-In HTML", "GET /nope HTTP/1.1\r\nHost: plain\r\n", "GET", 404, "text/html; charset=utf-8", builtinHTML("404 Not Found")},
+		{"Built-In Plain Text", "GET /nope HTTP/1.1\r\nHost: plain\r\nAccept: text/plain\r\n", "GET", 404, "text/plain; charset=utf-8", "404 Not Found\n"},
+		{"Built-In Prefers HTML", "GET /nope HTTP/1.1\r\nHost: plain\r\nAccept: text/plain;q=0.5, text/html\r\n", "GET", 404, "text/html; charset=utf-8", builtinHTML("404 Not Found")},
+		{"Unknown Host", "GET / HTTP/1.1\r\nHost: unknown\r\nAccept: text/plain\r\n", "GET", 404, "text/plain; charset=utf-8", "404 Not Found\n"},
+		{"Malformed Request", "GET / HTTP/1.0\r\nHost: custom\r\n", "GET", 400, "text/html; charset=utf-8", builtinHTML("400 Bad Request")},
+		{"Unsupported Method", "BREW / HTTP/1.1\r\nHost: custom\r\n", "BREW", 501, "text/html; charset=utf-8", builtinHTML("501 Not Implemented")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.request
+			if !strings.Contains(req, "\r\n\r\n") {
+				req += "Connection: close\r\n\r\n"
+			}
+			respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+			require.NoError(t, err, ErrSendingRequest)
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), &http.Request{Method: tt.method})
+			require.NoError(t, err, ErrParsingResponse)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err, "Error reading response body")
+			resp.Body.Close()
+
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode, "Test %s: %s", tt.name, ErrStatusMsg)
+			assert.Equal(t, tt.expectedType, resp.Header.Get("Content-Type"), "Test %s: Content-Type mismatch", tt.name)
+			assert.Equal(t, tt.expectedBody, string(body), "Test %s: body mismatch", tt.name)
+			if tt.method == "HEAD" {
+				assert.Equal(t, strconv.Itoa(len(files["site/errors/404.html"])), resp.Header.Get("Content-Length"), "Test %s: Content-Length mismatch", tt.name)
+			} else {
+				assert.Equal(t, int64(len(body)), resp.ContentLength, "Test %s: Content-Length mismatch", tt.name)
+			}
+		})
+	}
+
+	t.Run("Keep-Alive After Error", func(t *testing.T) {
+		req := "GET /nope HTTP/1.1\r\n" +
+			"Host: custom\r\n" +
+			"\r\n" +
+			"GET /index.html HTTP/1.1\r\n" +
+			"Host: custom\r\n" +
+			"Connection: close\r\n" +
+			"\r\n"
+
+		respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+		require.NoError(t, err, ErrSendingRequest)
+		respreader := bufio.NewReader(bytes.NewReader(respbytes))
+
+		for i, expected := range []string{files["site/errors/404.html"], "home"} {
+			resp, err := http.ReadResponse(respreader, nil)
+			require.NoError(t, err, "Error parsing the response %d", i+1)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err, "Error reading response body %d", i+1)
+			assert.Equal(t, expected, string(body), "Response %d: body mismatch", i+1)
+		}
+	})
+}
+
+func TestContentTypes(t *testing.T) {
+	t.Parallel()
+
+	docRoot := t.TempDir()
+	files := map[string]string{
+		"page.html":   "<html></html>",
+		"style.css":   "body {}",
+		"app.js":      "console.log(1)",
+		"data.json":   "{}",
+		"icon.svg":    "<svg></svg>",
+		"notes.md":    "# notes",
+		"PHOTO.JPG":   "\xff\xd8\xff",
+		"blob.xyz":    "\x00\x01\x02",
+		"noext":       "<!DOCTYPE html><html><body>sniffed</body></html>",
+		"binary":      "\x00\x01\x02",
+		"legacy.html": "<html></html>",
+	}
+	for name, data := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(docRoot, name), []byte(data), 0644))
+	}
+
+	s := &tritonhttp.Server{
+		Addr: "localhost:0",
+		VirtualHosts: map[string]tritonhttp.VirtualHost{
+			"builtin": {DocRoot: docRoot},
+			"custom": {DocRoot: docRoot, MIME: tritonhttp.MIMEConfig{
+				Types: map[string]string{
+					".md":   "text/x-markdown",
+					".xyz":  "application/x-custom",
+					".html": "text/html; charset=iso-8859-1",
+				},
+				Default: "text/plain",
+				Charset: "windows-1252",
+				Sniff:   true,
+			}},
+			"nocharset": {DocRoot: docRoot, MIME: tritonhttp.MIMEConfig{Charset: "none"}},
+		},
+	}
+	addr := servetritonhttpd(t, s)
+
+	tests := []struct {
+		vhost        string
+		target       string
+		expectedType string
+	}{
+		{"builtin", "/page.html", "text/html; charset=utf-8"},
+		{"builtin", "/style.css", "text/css; charset=utf-8"},
+		{"builtin", "/app.js", "text/javascript; charset=utf-8"},
+		{"builtin", "/data.json", "application/json"},
+		{"builtin", "/icon.svg", "image/svg+xml"},
+		{"builtin", "/notes.md", "text/markdown; charset=utf-8"},
+		{"builtin", "/PHOTO.JPG", "image/jpeg"},
+		{"builtin", "/blob.xyz", "application/octet-stream"},
+		{"builtin", "/noext", "application/octet-stream"},
+		{"custom", "/notes.md", "text/x-markdown; charset=windows-1252"},
+		{"custom", "/blob.xyz", "application/x-custom"},
+		{"custom", "/legacy.html", "text/html; charset=iso-8859-1"},
+		{"custom", "/style.css", "text/css; charset=windows-1252"},
+		{"custom", "/noext", "text/html; charset=utf-8"},
+		{"custom", "/binary", "text/plain; charset=windows-1252"},
+		{"nocharset", "/style.css", "text/css"},
+		{"nocharset", "/data.json", "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.vhost+tt.target, func(t *testing.T) {
+			resp, _ := fetchFrom(t, addr.String(), "GET", tt.vhost, tt.target, "")
+			assert.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+			assert.Equal(t, tt.expectedType, resp.Header.Get("Content-Type"), "Content-Type mismatch")
+		})
+	}
+}
+
 func TestFakePathTraversalAttack(t *testing.T) {
-	launchhttpd(t)
+	t.Parallel()
+	host, port := launchhttpd(t)
 
 	req := "GET /../htdocs2/../htdocs1/kitten.jpg HTTP/1.1\r\n" +
 		"Host: website1\r\n" +
 		"\r\n"
 
-	respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
+	respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
 	require.NoError(t, err, ErrSendingRequest)
 
 	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
@@ -259,11 +915,12 @@ func TestFakePathTraversalAttack(t *testing.T) {
 }
 
 func TestEmptyRequest(t *testing.T) {
-	launchhttpd(t)
+	t.Parallel()
+	host, port := launchhttpd(t)
 
 	req := ""
 
-	respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
+	respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
 	require.NoError(t, err, ErrSendingRequest)
 
 	_, err = http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
@@ -271,11 +928,12 @@ func TestEmptyRequest(t *testing.T) {
 }
 
 func TestPartialRequest(t *testing.T) {
-	launchhttpd(t)
+	t.Parallel()
+	host, port := launchhttpd(t)
 
 	req := "GET / HTTP/1.1\r\n"
 
-	respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
+	respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
 	require.NoError(t, err, ErrSendingRequest)
 
 	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
@@ -288,9 +946,10 @@ func TestPartialRequest(t *testing.T) {
 }
 
 func TestSlowButCompleteHTTPRequest(t *testing.T) {
-	launchhttpd(t)
+	t.Parallel()
+	host, port := launchhttpd(t)
 
-	conn, err := net.Dial("tcp", "localhost:8080")
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
 	require.NoError(t, err, "Failed to dial the server")
 	defer conn.Close()
 
@@ -316,9 +975,10 @@ func TestSlowButCompleteHTTPRequest(t *testing.T) {
 }
 
 func TestSlowAndIncompleteHTTPRequest(t *testing.T) {
-	launchhttpd(t)
+	t.Parallel()
+	host, port := launchhttpd(t)
 
-	conn, err := net.Dial("tcp", "localhost:8080")
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
 	require.NoError(t, err, "Failed to dial the server")
 	defer conn.Close()
 
@@ -343,7 +1003,8 @@ func TestSlowAndIncompleteHTTPRequest(t *testing.T) {
 }
 
 func TestHTTPRequestParsing(t *testing.T) {
-	launchhttpd(t)
+	t.Parallel()
+	host, port := launchhttpd(t)
 
 	tests := []struct {
 		name           string
@@ -404,6 +1065,18 @@ func TestHTTPRequestParsing(t *testing.T) {
 			name: "Unsupported HTTP Method",
 			request: "PATCH /index.html HTTP/1.1\r\n" +
 				"Host: website2\r\n\r\n",
+			expectedStatus: 405,
+		},
+		{
+			name: "Unknown HTTP Method",
+			request: "BREW /index.html HTTP/1.1\r\n" +
+				"Host: website2\r\n\r\n",
+			expectedStatus: 501,
+		},
+		{
+			name: "Malformed HTTP Method",
+			request: "G(E)T /index.html HTTP/1.1\r\n" +
+				"Host: website2\r\n\r\n",
 			expectedStatus: 400,
 		},
 		{
@@ -437,7 +1110,7 @@ func TestHTTPRequestParsing(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(tt.request))
+			respbytes, _, err := tritonhttp.Fetch(host, port, []byte(tt.request))
 			require.NoError(t, err, "%s for test: %s", ErrSendingRequest, tt.name)
 
 			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
@@ -449,6 +1122,9 @@ func TestHTTPRequestParsing(t *testing.T) {
 			if resp.StatusCode == 400 {
 				assert.Equal(t, true, resp.Close, "Test %s: %s", tt.name, ErrConnectionHeaderMsg)
 			}
+			if resp.StatusCode == 405 {
+				assert.Equal(t, "GET, HEAD", resp.Header.Get("Allow"), "Test %s: Allow header mismatch", tt.name)
+			}
 			if resp.StatusCode == 200 {
 				assert.NotEmpty(t, resp.Header.Get("Content-Length"), "Test %s: Content-Length header missing", tt.name)
 				assert.NotEmpty(t, resp.Header.Get("Content-Type"), "Test %s: Content-Type header missing", tt.name)
@@ -459,56 +1135,2234 @@ func TestHTTPRequestParsing(t *testing.T) {
 	}
 }
 
-func TestAllFilesInHtdocs(t *testing.T) {
-	launchhttpd(t)
+func TestHeadRequest(t *testing.T) {
+	t.Parallel()
+	host, port := launchhttpd(t)
 
-	virtualHosts := tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")
+	// The HEAD response must not carry a body, so the pipelined GET response
+	// has to follow its headers immediately
+	req := "HEAD /kitten.jpg HTTP/1.1\r\n" +
+		"Host: website1\r\n" +
+		"\r\n" +
+		"GET /kitten.jpg HTTP/1.1\r\n" +
+		"Host: website1\r\n" +
+		"Connection: close\r\n" +
+		"\r\n"
 
-	for hostname, docRoot := range virtualHosts {
-		err := filepath.Walk(docRoot, func(path string, info os.FileInfo, err error) error {
-			require.NoError(t, err, "Error walking through docRoot")
+	respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+	require.NoError(t, err, ErrSendingRequest)
 
-			if info.IsDir() {
-				return nil
-			}
+	respreader := bufio.NewReader(bytes.NewReader(respbytes))
 
-			testfile := strings.TrimPrefix(path, docRoot)
-			t.Run(testfile, func(t *testing.T) {
-				req := fmt.Sprintf("GET %s HTTP/1.1\r\n"+
-					"Host: "+hostname+"\r\n"+
-					"Connection: close\r\n"+
-					"User-Agent: gotest\r\n"+
-					"\r\n", testfile)
+	head, err := http.ReadResponse(respreader, &http.Request{Method: "HEAD"})
+	require.NoError(t, err, "Error parsing the HEAD response")
+	head.Body.Close()
+
+	get, err := http.ReadResponse(respreader, nil)
+	require.NoError(t, err, "Error parsing the GET response")
+	body, err := io.ReadAll(get.Body)
+	require.NoError(t, err, "Error reading GET response body")
+	get.Body.Close()
+
+	assert.Equal(t, 200, head.StatusCode, ErrStatusMsg)
+	assert.Equal(t, 200, get.StatusCode, ErrStatusMsg)
+	assert.Equal(t, get.ContentLength, head.ContentLength, "Content-Length mismatch")
+	assert.Equal(t, int64(len(body)), get.ContentLength, "Response body length mismatch")
+	assert.Equal(t, get.Header.Get("Content-Type"), head.Header.Get("Content-Type"), "Content-Type mismatch")
+	assert.Equal(t, get.Header.Get("Last-Modified"), head.Header.Get("Last-Modified"), "Last-Modified mismatch")
+	assert.Equal(t, true, get.Close, ErrConnectionHeaderMsg)
+}
 
-				respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
-				require.NoError(t, err, ErrSendingRequest)
+func TestConditionalRequests(t *testing.T) {
+	t.Parallel()
+	addr := net.JoinHostPort(launchhttpd(t))
 
-				resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
-				require.NoError(t, err, ErrParsingResponse)
+	first, _ := fetchFrom(t, addr, "GET", "website1", "/kitten.jpg", "")
+	require.Equal(t, 200, first.StatusCode, ErrStatusMsg)
+	etag := first.Header.Get("ETag")
+	lastModified := first.Header.Get("Last-Modified")
+	require.NotEmpty(t, etag, "ETag header is missing")
+	require.NotEmpty(t, lastModified, "Last-Modified header is missing")
 
-				assert.Equal(t, HTTP1_1, resp.Proto, ErrProtocolMsg)
-				assert.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+	tests := []struct {
+		name           string
+		headers        string
+		expectedStatus int
+	}{
+		{"If-None-Match Current ETag", "If-None-Match: " + etag + "\r\n", 304},
+		{"If-None-Match Weak ETag", "If-None-Match: W/" + etag + "\r\n", 304},
+		{"If-None-Match ETag List", "If-None-Match: \"stale\", " + etag + "\r\n", 304},
+		{"If-None-Match Star", "If-None-Match: *\r\n", 304},
+		{"If-None-Match Stale ETag", "If-None-Match: \"stale\"\r\n", 200},
+		{"If-Modified-Since Last-Modified", "If-Modified-Since: " + lastModified + "\r\n", 304},
+		{"If-Modified-Since Epoch", "If-Modified-Since: Thu, 01 Jan 1970 00:00:00 GMT\r\n", 200},
+		{"If-Modified-Since Invalid Date", "If-Modified-Since: yesterday\r\n", 200},
+		{"If-None-Match Takes Precedence", "If-None-Match: \"stale\"\r\nIf-Modified-Since: " + lastModified + "\r\n", 200},
+		{"If-Match Current ETag", "If-Match: " + etag + "\r\n", 200},
+		{"If-Match Weak ETag", "If-Match: W/" + etag + "\r\n", 412},
+		{"If-Match Stale ETag", "If-Match: \"stale\"\r\n", 412},
+		{"If-Unmodified-Since Last-Modified", "If-Unmodified-Since: " + lastModified + "\r\n", 200},
+		{"If-Unmodified-Since Epoch", "If-Unmodified-Since: Thu, 01 Jan 1970 00:00:00 GMT\r\n", 412},
+		{"If-Match Takes Precedence", "If-Match: " + etag + "\r\nIf-Unmodified-Since: Thu, 01 Jan 1970 00:00:00 GMT\r\n", 200},
+	}
 
-				respcontenttype := resp.Header.Get("Content-Type")
-				assert.NotEmpty(t, respcontenttype, "Content-Type header is missing")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := fetchFrom(t, addr, "GET", "website1", "/kitten.jpg", tt.headers)
 
-				origmimetype := mime.TypeByExtension(filepath.Ext(path))
-				assert.Contains(t, origmimetype, respcontenttype, "Content-Type mismatch")
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode, "Test %s: %s", tt.name, ErrStatusMsg)
+			if resp.StatusCode == 304 {
+				assert.Empty(t, body, "Test %s: 304 response must not have a body", tt.name)
+				assert.Equal(t, etag, resp.Header.Get("ETag"), "Test %s: ETag mismatch", tt.name)
+			}
+			if resp.StatusCode == 200 {
+				assert.Equal(t, first.ContentLength, int64(len(body)), "Test %s: Response body length mismatch", tt.name)
+			}
+		})
+	}
+}
 
-				assert.Equal(t, info.Size(), resp.ContentLength, "Content-Length mismatch")
+func TestRangeRequests(t *testing.T) {
+	t.Parallel()
+	addr := net.JoinHostPort(launchhttpd(t))
 
-				origcontents, err := os.ReadFile(path)
-				require.NoError(t, err, "Error reading input file")
+	orig, err := os.ReadFile("../../docroot_dirs/htdocs1/kitten.jpg")
+	require.NoError(t, err, "Error reading input file")
+	size := len(orig)
 
-				respcontents, err := io.ReadAll(resp.Body)
-				require.NoError(t, err, "Error reading response body")
-				resp.Body.Close()
+	get := func(t *testing.T, headers string) (*http.Response, []byte) {
+		resp, body := fetchFrom(t, addr, "GET", "website1", "/kitten.jpg", headers)
+		assert.Equal(t, resp.ContentLength, int64(len(body)), "Response body length mismatch")
+		return resp, body
+	}
 
-				assert.True(t, bytes.Equal(origcontents, respcontents), "Response body does not match original file contents")
-			})
+	full, _ := get(t, "")
+	assert.Equal(t, 200, full.StatusCode, ErrStatusMsg)
+	assert.Equal(t, "bytes", full.Header.Get("Accept-Ranges"), "Accept-Ranges header mismatch")
+	etag := full.Header.Get("ETag")
 
-			return nil
+	single := []struct {
+		name          string
+		headers       string
+		start, end    int
+		expectedRange string
+	}{
+		{"First Bytes", "Range: bytes=0-9\r\n", 0, 9, fmt.Sprintf("bytes 0-9/%d", size)},
+		{"Open Ended", "Range: bytes=100-\r\n", 100, size - 1, fmt.Sprintf("bytes 100-%d/%d", size-1, size)},
+		{"Suffix", "Range: bytes=-10\r\n", size - 10, size - 1, fmt.Sprintf("bytes %d-%d/%d", size-10, size-1, size)},
+		{"End Past File", fmt.Sprintf("Range: bytes=10-%d\r\n", size+100), 10, size - 1, fmt.Sprintf("bytes 10-%d/%d", size-1, size)},
+		{"If-Range Current ETag", "Range: bytes=0-9\r\nIf-Range: " + etag + "\r\n", 0, 9, fmt.Sprintf("bytes 0-9/%d", size)},
+		{"If-Range Last-Modified", "Range: bytes=0-9\r\nIf-Range: " + full.Header.Get("Last-Modified") + "\r\n", 0, 9, fmt.Sprintf("bytes 0-9/%d", size)},
+	}
+	for _, tt := range single {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := get(t, tt.headers)
+			assert.Equal(t, 206, resp.StatusCode, "Test %s: %s", tt.name, ErrStatusMsg)
+			assert.Equal(t, tt.expectedRange, resp.Header.Get("Content-Range"), "Test %s: Content-Range mismatch", tt.name)
+			assert.Equal(t, orig[tt.start:tt.end+1], body, "Test %s: Response body mismatch", tt.name)
+		})
+	}
+
+	t.Run("Multiple Ranges", func(t *testing.T) {
+		resp, body := get(t, "Range: bytes=0-9, -5\r\n")
+		assert.Equal(t, 206, resp.StatusCode, ErrStatusMsg)
+
+		mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		require.NoError(t, err, "Error parsing Content-Type")
+		assert.Equal(t, "multipart/byteranges", mediaType)
+
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		expected := []struct {
+			contentRange string
+			data         []byte
+		}{
+			{fmt.Sprintf("bytes 0-9/%d", size), orig[:10]},
+			{fmt.Sprintf("bytes %d-%d/%d", size-5, size-1, size), orig[size-5:]},
+		}
+		for _, want := range expected {
+			part, err := mr.NextPart()
+			require.NoError(t, err, "Error reading body part")
+			assert.Equal(t, "image/jpeg", part.Header.Get("Content-Type"))
+			assert.Equal(t, want.contentRange, part.Header.Get("Content-Range"))
+			data, err := io.ReadAll(part)
+			require.NoError(t, err, "Error reading body part")
+			assert.Equal(t, want.data, data)
+		}
+		_, err = mr.NextPart()
+		assert.ErrorIs(t, err, io.EOF, "Expected exactly two body parts")
+	})
+
+	t.Run("Unsatisfiable Range", func(t *testing.T) {
+		resp, body := get(t, fmt.Sprintf("Range: bytes=%d-\r\n", size))
+		assert.Equal(t, 416, resp.StatusCode, ErrStatusMsg)
+		assert.Equal(t, fmt.Sprintf("bytes */%d", size), resp.Header.Get("Content-Range"))
+		assert.NotEmpty(t, body, "416 response should carry an error page")
+	})
+
+	ignored := []struct {
+		name    string
+		headers string
+	}{
+		{"Malformed Range", "Range: bytes=abc\r\n"},
+		{"Signed Position", "Range: bytes=+1-2\r\n"},
+		{"Signed Suffix", "Range: bytes=-+5\r\n"},
+		{"Unknown Unit", "Range: pages=1-2\r\n"},
+		{"If-Range Stale ETag", "Range: bytes=0-9\r\nIf-Range: \"stale\"\r\n"},
+		{"If-Range Weak ETag", "Range: bytes=0-9\r\nIf-Range: W/" + etag + "\r\n"},
+		{"Overlapping Ranges", "Range: bytes=0-, 0-\r\n"},
+	}
+	for _, tt := range ignored {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := get(t, tt.headers)
+			assert.Equal(t, 200, resp.StatusCode, "Test %s: %s", tt.name, ErrStatusMsg)
+			assert.Equal(t, orig, body, "Test %s: Response body mismatch", tt.name)
+		})
+	}
+}
+
+func TestCompression(t *testing.T) {
+	t.Parallel()
+	addr := servetritonhttpd(t, &tritonhttp.Server{
+		Addr:         "localhost:0",
+		VirtualHosts: tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs"),
+	})
+	host, port, err := net.SplitHostPort(addr.String())
+	require.NoError(t, err, "Error parsing listen address")
+
+	orig, err := os.ReadFile("../../docroot_dirs/htdocs1/hidden/large.html")
+	require.NoError(t, err, "Error reading input file")
+
+	decode := func(t *testing.T, encoding string, body []byte) []byte {
+		var r io.Reader
+		var err error
+		switch encoding {
+		case "gzip":
+			r, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			r, err = zlib.NewReader(bytes.NewReader(body))
+		default:
+			return body
+		}
+		require.NoError(t, err, "Error decoding %v body", encoding)
+		decoded, err := io.ReadAll(r)
+		require.NoError(t, err, "Error decoding %v body", encoding)
+		return decoded
+	}
+
+	tests := []struct {
+		name             string
+		target           string
+		acceptEncoding   string
+		expectedEncoding string
+		expectedVary     bool
+	}{
+		{"Gzip", "/hidden/large.html", "gzip", "gzip", true},
+		{"Deflate", "/hidden/large.html", "deflate", "deflate", true},
+		{"Highest Q-Value", "/hidden/large.html", "gzip;q=0.5, deflate;q=0.8", "deflate", true},
+		{"Tie Prefers Gzip", "/hidden/large.html", "deflate, gzip", "gzip", true},
+		{"Wildcard", "/hidden/large.html", "*", "gzip", true},
+		{"Identity Preferred", "/hidden/large.html", "gzip;q=0.5, identity", "", true},
+		{"Gzip Refused", "/hidden/large.html", "gzip;q=0, br", "", true},
+		{"No Accept-Encoding", "/hidden/large.html", "", "", true},
+		{"Below Minimum Size", "/index.html", "gzip", "", false},
+		{"Not Compressible", "/kitten.jpg", "gzip", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := ""
+			if tt.acceptEncoding != "" {
+				headers = "Accept-Encoding: " + tt.acceptEncoding + "\r\n"
+			}
+			resp, body := fetchFrom(t, addr.String(), "GET", "website1", tt.target, headers)
+			assert.Equal(t, 200, resp.StatusCode, "Test %s: %s", tt.name, ErrStatusMsg)
+			assert.Equal(t, tt.expectedEncoding, resp.Header.Get("Content-Encoding"), "Test %s: Content-Encoding mismatch", tt.name)
+			if tt.expectedVary {
+				assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"), "Test %s: Vary mismatch", tt.name)
+			} else {
+				assert.Empty(t, resp.Header.Get("Vary"), "Test %s: unexpected Vary", tt.name)
+			}
+
+			if tt.expectedEncoding == "" {
+				assert.Equal(t, resp.ContentLength, int64(len(body)), "Test %s: Content-Length mismatch", tt.name)
+				return
+			}
+			assert.Equal(t, int64(-1), resp.ContentLength, "Test %s: compressed body should have no Content-Length", tt.name)
+			assert.Less(t, len(body), len(orig), "Test %s: body was not compressed", tt.name)
+			assert.Equal(t, orig, decode(t, tt.expectedEncoding, body), "Test %s: decoded body mismatch", tt.name)
+			assert.True(t, strings.HasPrefix(resp.Header.Get("ETag"), "W/"), "Test %s: compressed ETag should be weak", tt.name)
+			assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"), "Test %s: Content-Type mismatch", tt.name)
 		})
-		require.NoError(t, err, "Error walking the file tree")
 	}
+
+	t.Run("Range Is Not Compressed", func(t *testing.T) {
+		resp, body := fetchFrom(t, addr.String(), "GET", "website1", "/hidden/large.html", "Accept-Encoding: gzip\r\nRange: bytes=0-99\r\n")
+		assert.Equal(t, 206, resp.StatusCode, ErrStatusMsg)
+		assert.Empty(t, resp.Header.Get("Content-Encoding"), "Range response should not be compressed")
+		assert.Equal(t, orig[:100], body, "Range body mismatch")
+	})
+
+	t.Run("Not Modified", func(t *testing.T) {
+		resp, _ := fetchFrom(t, addr.String(), "GET", "website1", "/hidden/large.html", "Accept-Encoding: gzip\r\n")
+		etag := resp.Header.Get("ETag")
+
+		resp, _ = fetchFrom(t, addr.String(), "GET", "website1", "/hidden/large.html", "Accept-Encoding: gzip\r\nIf-None-Match: "+etag+"\r\n")
+		assert.Equal(t, 304, resp.StatusCode, ErrStatusMsg)
+		assert.Equal(t, etag, resp.Header.Get("ETag"), "ETag mismatch")
+	})
+
+	t.Run("Head", func(t *testing.T) {
+		// The HEAD response has the headers of the compressed GET and no
+		// body, so the response that follows is still read correctly
+		req := "HEAD /hidden/large.html HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"Accept-Encoding: gzip\r\n" +
+			"\r\n" +
+			"GET /hidden/large.html HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"Accept-Encoding: gzip\r\n" +
+			"Connection: close\r\n" +
+			"\r\n"
+
+		respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+		require.NoError(t, err, ErrSendingRequest)
+		respreader := bufio.NewReader(bytes.NewReader(respbytes))
+
+		head, err := http.ReadResponse(respreader, &http.Request{Method: "HEAD"})
+		require.NoError(t, err, ErrParsingResponse)
+		head.Body.Close()
+		assert.Equal(t, 200, head.StatusCode, ErrStatusMsg)
+		assert.Equal(t, "gzip", head.Header.Get("Content-Encoding"), "Content-Encoding mismatch")
+		assert.Equal(t, "Accept-Encoding", head.Header.Get("Vary"), "Vary mismatch")
+		assert.Empty(t, head.Header.Get("Content-Length"), "HEAD should not declare the uncompressed length")
+
+		resp, err := http.ReadResponse(respreader, nil)
+		require.NoError(t, err, ErrParsingResponse)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "Error reading response body")
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"), "Content-Encoding mismatch")
+		assert.Equal(t, head.Header.Get("ETag"), resp.Header.Get("ETag"), "HEAD and GET ETags differ")
+		assert.Equal(t, orig, decode(t, "gzip", body), "Decoded body mismatch")
+	})
+}
+
+func TestPrecompressedFiles(t *testing.T) {
+	t.Parallel()
+
+	docRoot := t.TempDir()
+	style := []byte(strings.Repeat("body { color: black; }\n", 100))
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, err := zw.Write(style)
+	require.NoError(t, err, "Error compressing file")
+	require.NoError(t, zw.Close(), "Error compressing file")
+
+	// The sidecar contents are opaque to the server, so only the gzip one
+	// needs to be real
+	files := map[string][]byte{
+		"style.css":     style,
+		"style.css.gz":  gz.Bytes(),
+		"style.css.br":  []byte("brotli bytes"),
+		"app.js":        []byte("console.log('app');\n"),
+		"app.js.zst":    []byte("zstd bytes"),
+		"plain.txt":     []byte("no sidecar"),
+		"stale.txt":     []byte("fresh"),
+		"stale.txt.gz":  []byte("stale gzip bytes"),
+		"index.html":    []byte("<html></html>"),
+		"index.html.gz": []byte("gzip index bytes"),
+	}
+	modTime := time.Now().Add(-time.Hour)
+	for name, data := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(docRoot, name), data, 0644))
+		require.NoError(t, os.Chtimes(filepath.Join(docRoot, name), modTime, modTime))
+	}
+	past := modTime.Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(docRoot, "stale.txt.gz"), past, past))
+
+	s := &tritonhttp.Server{
+		Addr: "localhost:0",
+		VirtualHosts: map[string]tritonhttp.VirtualHost{
+			"website1": {DocRoot: docRoot, Compression: tritonhttp.CompressionConfig{Precompressed: true}},
+			"website2": {DocRoot: docRoot},
+		},
+	}
+	addr := servetritonhttpd(t, s).String()
+
+	tests := []struct {
+		name             string
+		vhost            string
+		target           string
+		acceptEncoding   string
+		expectedEncoding string
+		expectedBody     []byte
+		expectedVary     bool
+	}{
+		{"Brotli Preferred", "website1", "/style.css", "gzip, deflate, br", "br", files["style.css.br"], true},
+		{"Gzip Only", "website1", "/style.css", "gzip", "gzip", files["style.css.gz"], true},
+		{"Q-Values", "website1", "/style.css", "br;q=0.2, gzip;q=0.9", "gzip", files["style.css.gz"], true},
+		{"Zstd", "website1", "/app.js", "zstd, gzip", "zstd", files["app.js.zst"], true},
+		{"No Matching Sidecar", "website1", "/app.js", "gzip", "", files["app.js"], true},
+		{"No Accept-Encoding", "website1", "/style.css", "", "", files["style.css"], true},
+		{"No Sidecar", "website1", "/plain.txt", "gzip, br, zstd", "", files["plain.txt"], false},
+		{"Stale Sidecar", "website1", "/stale.txt", "gzip", "", files["stale.txt"], false},
+		{"Directory Index", "website1", "/", "gzip", "gzip", files["index.html.gz"], true},
+		{"Disabled", "website2", "/style.css", "gzip, br", "", files["style.css"], false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := ""
+			if tt.acceptEncoding != "" {
+				headers = "Accept-Encoding: " + tt.acceptEncoding + "\r\n"
+			}
+			resp, body := fetchFrom(t, addr, "GET", tt.vhost, tt.target, headers)
+			assert.Equal(t, 200, resp.StatusCode, "Test %s: %s", tt.name, ErrStatusMsg)
+			assert.Equal(t, tt.expectedEncoding, resp.Header.Get("Content-Encoding"), "Test %s: Content-Encoding mismatch", tt.name)
+			assert.Equal(t, tt.expectedBody, body, "Test %s: body mismatch", tt.name)
+			assert.Equal(t, int64(len(tt.expectedBody)), resp.ContentLength, "Test %s: Content-Length mismatch", tt.name)
+			if tt.expectedVary {
+				assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"), "Test %s: Vary mismatch", tt.name)
+			} else {
+				assert.Empty(t, resp.Header.Get("Vary"), "Test %s: unexpected Vary", tt.name)
+			}
+		})
+	}
+
+	t.Run("Content-Type Of Original", func(t *testing.T) {
+		resp, body := fetchFrom(t, addr, "GET", "website1", "/style.css", "Accept-Encoding: gzip\r\n")
+		assert.Equal(t, "text/css; charset=utf-8", resp.Header.Get("Content-Type"), "Content-Type mismatch")
+
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err, "Error decoding gzip body")
+		decoded, err := io.ReadAll(zr)
+		require.NoError(t, err, "Error decoding gzip body")
+		assert.Equal(t, style, decoded, "Decoded body mismatch")
+	})
+
+	t.Run("Head", func(t *testing.T) {
+		resp, body := fetchFrom(t, addr, "HEAD", "website1", "/style.css", "Accept-Encoding: br\r\n")
+		assert.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+		assert.Equal(t, "br", resp.Header.Get("Content-Encoding"), "Content-Encoding mismatch")
+		assert.Equal(t, strconv.Itoa(len(files["style.css.br"])), resp.Header.Get("Content-Length"), "Content-Length mismatch")
+		assert.Empty(t, body, "HEAD response should have no body")
+	})
+
+	t.Run("Range Uses Original", func(t *testing.T) {
+		resp, body := fetchFrom(t, addr, "GET", "website1", "/style.css", "Accept-Encoding: gzip\r\nRange: bytes=0-3\r\n")
+		assert.Equal(t, 206, resp.StatusCode, ErrStatusMsg)
+		assert.Empty(t, resp.Header.Get("Content-Encoding"), "Range response should not be encoded")
+		assert.Equal(t, style[:4], body, "Range body mismatch")
+	})
+
+	t.Run("Distinct ETags", func(t *testing.T) {
+		identity, _ := fetchFrom(t, addr, "GET", "website1", "/style.css", "")
+		encoded, _ := fetchFrom(t, addr, "GET", "website1", "/style.css", "Accept-Encoding: gzip\r\n")
+		assert.NotEqual(t, identity.Header.Get("ETag"), encoded.Header.Get("ETag"), "Variants should have different ETags")
+
+		resp, _ := fetchFrom(t, addr, "GET", "website1", "/style.css", "Accept-Encoding: gzip\r\nIf-None-Match: "+encoded.Header.Get("ETag")+"\r\n")
+		assert.Equal(t, 304, resp.StatusCode, ErrStatusMsg)
+	})
+}
+
+func TestVirtualHostMatching(t *testing.T) {
+	t.Parallel()
+
+	htdocs := func(name string) string {
+		return filepath.Join("../../docroot_dirs", name)
+	}
+	index := func(name string) []byte {
+		contents, err := os.ReadFile(filepath.Join(htdocs(name), "index.html"))
+		require.NoError(t, err, "Error reading input file")
+		return contents
+	}
+
+	withDefault := &tritonhttp.Server{
+		Addr: "localhost:0",
+		VirtualHosts: map[string]tritonhttp.VirtualHost{
+			"website1":            {DocRoot: htdocs("htdocs1")},
+			"*.example.test":      {DocRoot: htdocs("htdocs2")},
+			"*.deep.example.test": {DocRoot: htdocs("htdocs1")},
+			"*":                   {DocRoot: htdocs("htdocs3")},
+		},
+	}
+	withoutDefault := &tritonhttp.Server{
+		Addr: "localhost:0",
+		VirtualHosts: map[string]tritonhttp.VirtualHost{
+			"website1":       {DocRoot: htdocs("htdocs1")},
+			"*.example.test": {DocRoot: htdocs("htdocs2")},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		server         *tritonhttp.Server
+		host           string
+		expectedStatus int
+		expectedDocs   string
+	}{
+		{"Exact Name", withDefault, "website1", 200, "htdocs1"},
+		{"Exact Name Different Case", withDefault, "WebSite1", 200, "htdocs1"},
+		{"Exact Name With Port", withDefault, "website1:8080", 200, "htdocs1"},
+		{"Exact Name With Trailing Dot", withDefault, "website1.", 200, "htdocs1"},
+		{"Wildcard Subdomain", withDefault, "www.example.test", 200, "htdocs2"},
+		{"Wildcard Subdomain With Port", withDefault, "WWW.Example.Test:8080", 200, "htdocs2"},
+		{"Longest Wildcard Wins", withDefault, "a.deep.example.test", 200, "htdocs1"},
+		{"Wildcard Does Not Match Apex", withDefault, "example.test", 200, "htdocs3"},
+		{"Unknown Host Uses Default", withDefault, "unknown", 200, "htdocs3"},
+		{"IP Address Uses Default", withDefault, "127.0.0.1:8080", 200, "htdocs3"},
+		{"Unknown Host Without Default", withoutDefault, "unknown", 404, ""},
+		{"Wildcard Without Default", withoutDefault, "www.example.test", 200, "htdocs2"},
+		{"Apex Without Default", withoutDefault, "example.test", 404, ""},
+	}
+
+	addrs := map[*tritonhttp.Server]net.Addr{
+		withDefault:    servetritonhttpd(t, withDefault),
+		withoutDefault: servetritonhttpd(t, withoutDefault),
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port, err := net.SplitHostPort(addrs[tt.server].String())
+			require.NoError(t, err, "Error parsing listen address")
+
+			req := "GET / HTTP/1.1\r\n" +
+				"Host: " + tt.host + "\r\n" +
+				"Connection: close\r\n" +
+				"\r\n"
+
+			respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+			require.NoError(t, err, ErrSendingRequest)
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			require.NoError(t, err, ErrParsingResponse)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err, "Error reading response body")
+			resp.Body.Close()
+
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode, "Test %s: %s", tt.name, ErrStatusMsg)
+			if tt.expectedStatus == 200 {
+				assert.Equal(t, index(tt.expectedDocs), body, "Test %s: served from the wrong docroot", tt.name)
+			}
+		})
+	}
+}
+
+func TestHandlerAndMiddleware(t *testing.T) {
+	t.Parallel()
+
+	app := tritonhttp.HandlerFunc(func(w tritonhttp.ResponseWriter, r *tritonhttp.Request) {
+		switch r.URL {
+		case "/hello":
+			body := "hello " + r.Query.Get("name")
+			w.Header()["Content-Type"] = "text/plain"
+			w.Header()["Content-Length"] = strconv.Itoa(len(body))
+			io.WriteString(w, body)
+		case "/stream":
+			io.WriteString(w, "streamed ")
+			io.WriteString(w, "without length")
+		case "/panic":
+			panic("boom")
+		case "/created":
+			w.Header()["Content-Length"] = "0"
+			w.WriteHeader(tritonhttp.StatusCreated)
+		case "/post-only":
+			w.Header()["Allow"] = "POST"
+			tritonhttp.Error(w, r, tritonhttp.StatusMethodNotAllowed)
+		default:
+			tritonhttp.FileHandler{}.ServeTriton(w, r)
+		}
+	})
+	trace := func(name string) tritonhttp.Middleware {
+		return func(next tritonhttp.Handler) tritonhttp.Handler {
+			return tritonhttp.HandlerFunc(func(w tritonhttp.ResponseWriter, r *tritonhttp.Request) {
+				w.Header()["X-Trace"] += name
+				next.ServeTriton(w, r)
+			})
+		}
+	}
+	denyHidden := func(next tritonhttp.Handler) tritonhttp.Handler {
+		return tritonhttp.HandlerFunc(func(w tritonhttp.ResponseWriter, r *tritonhttp.Request) {
+			if strings.HasPrefix(r.URL, "/hidden/") {
+				tritonhttp.Error(w, r, 404)
+				return
+			}
+			next.ServeTriton(w, r)
+		})
+	}
+
+	s := &tritonhttp.Server{
+		Addr:         "localhost:0",
+		VirtualHosts: tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs"),
+		Handler:      app,
+		Middleware:   []tritonhttp.Middleware{trace("a"), trace("b"), denyHidden},
+	}
+	host, port, err := net.SplitHostPort(servetritonhttpd(t, s).String())
+	require.NoError(t, err, "Error parsing listen address")
+
+	t.Run("Pipelined", func(t *testing.T) {
+		req := "GET /hello?name=triton HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"\r\n" +
+			"GET /hidden/large.html HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"\r\n" +
+			"GET /index.html HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"Connection: close\r\n" +
+			"\r\n"
+
+		respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+		require.NoError(t, err, ErrSendingRequest)
+		respreader := bufio.NewReader(bytes.NewReader(respbytes))
+
+		resp, err := http.ReadResponse(respreader, nil)
+		require.NoError(t, err, "Error parsing the response 1")
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "Error reading response body 1")
+		assert.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+		assert.Equal(t, "hello triton", string(body))
+		assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "ab", resp.Header.Get("X-Trace"), "Middleware order mismatch")
+		assert.NotEmpty(t, resp.Header.Get("Date"), "Date header missing")
+		assert.False(t, resp.Close, ErrConnectionHeaderMsg)
+
+		resp, err = http.ReadResponse(respreader, nil)
+		require.NoError(t, err, "Error parsing the response 2")
+		body, err = io.ReadAll(resp.Body)
+		require.NoError(t, err, "Error reading response body 2")
+		assert.Equal(t, 404, resp.StatusCode, ErrStatusMsg)
+		assert.Equal(t, int64(len(body)), resp.ContentLength, "Content-Length mismatch")
+
+		resp, err = http.ReadResponse(respreader, nil)
+		require.NoError(t, err, "Error parsing the response 3")
+		body, err = io.ReadAll(resp.Body)
+		require.NoError(t, err, "Error reading response body 3")
+		assert.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+		assert.Equal(t, int64(377), int64(len(body)), "Response body length mismatch")
+		assert.Equal(t, true, resp.Close, ErrConnectionHeaderMsg)
+	})
+
+	t.Run("Body Without Content-Length", func(t *testing.T) {
+		// The body is chunked, so the connection stays open for the next request
+		req := "GET /stream HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"\r\n" +
+			"GET /hello?name=again HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"Connection: close\r\n" +
+			"\r\n"
+
+		respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+		require.NoError(t, err, ErrSendingRequest)
+		respreader := bufio.NewReader(bytes.NewReader(respbytes))
+
+		resp, err := http.ReadResponse(respreader, nil)
+		require.NoError(t, err, ErrParsingResponse)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "Error reading response body")
+		assert.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+		assert.Equal(t, "streamed without length", string(body))
+		assert.Equal(t, []string{"chunked"}, resp.TransferEncoding, "Response should be chunked")
+		assert.Equal(t, false, resp.Close, ErrConnectionHeaderMsg)
+
+		resp, err = http.ReadResponse(respreader, nil)
+		require.NoError(t, err, ErrParsingResponse)
+		body, err = io.ReadAll(resp.Body)
+		require.NoError(t, err, "Error reading response body")
+		assert.Equal(t, "hello again", string(body))
+	})
+
+	t.Run("Panicking Handler", func(t *testing.T) {
+		req := "GET /panic HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"\r\n"
+
+		respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+		require.NoError(t, err, ErrSendingRequest)
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+		require.NoError(t, err, ErrParsingResponse)
+		resp.Body.Close()
+		assert.Equal(t, 500, resp.StatusCode, ErrStatusMsg)
+		assert.Equal(t, true, resp.Close, ErrConnectionHeaderMsg)
+	})
+
+	t.Run("Status Text", func(t *testing.T) {
+		resp, _ := fetchFrom(t, net.JoinHostPort(host, port), "GET", "website1", "/created", "")
+		assert.Equal(t, "201 Created", resp.Status, "Status line should carry the reason phrase")
+	})
+
+	t.Run("Allow Set By Handler", func(t *testing.T) {
+		resp, _ := fetchFrom(t, net.JoinHostPort(host, port), "GET", "website1", "/post-only", "")
+		assert.Equal(t, 405, resp.StatusCode, ErrStatusMsg)
+		assert.Equal(t, "POST", resp.Header.Get("Allow"), "Error should keep the Allow header of the handler")
+	})
+}
+
+func TestStreamingResponse(t *testing.T) {
+	t.Parallel()
+
+	proceed := make(chan struct{})
+	app := tritonhttp.HandlerFunc(func(w tritonhttp.ResponseWriter, r *tritonhttp.Request) {
+		switch r.URL {
+		case "/flush":
+			// The second part is only written once the client has the first
+			io.WriteString(w, "first ")
+			w.Flush()
+			select {
+			case <-proceed:
+			case <-time.After(tritonhttp.RECV_TIMEOUT):
+			}
+			io.WriteString(w, "second")
+		case "/trailer":
+			w.Header()["Trailer"] = "x-checksum, Content-Length"
+			w.Header()["X-Checksum"] = "early"
+			io.WriteString(w, "payload")
+			w.Header()["X-Checksum"] = "321c3cf486ed509164edec1e1981fec8"
+		case "/empty":
+			w.WriteHeader(200)
+			w.Flush()
+		case "/panic":
+			io.WriteString(w, "partial")
+			w.Flush()
+			panic("handler failed halfway")
+		case "/abort":
+			io.WriteString(w, "partial")
+			panic(tritonhttp.ErrAbortHandler)
+		default:
+			tritonhttp.FileHandler{}.ServeTriton(w, r)
+		}
+	})
+	s := &tritonhttp.Server{
+		Addr:         "localhost:0",
+		VirtualHosts: tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs"),
+		Handler:      app,
+	}
+	addr := servetritonhttpd(t, s)
+	host, port, err := net.SplitHostPort(addr.String())
+	require.NoError(t, err, "Error parsing listen address")
+
+	t.Run("Flush", func(t *testing.T) {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		require.NoError(t, err, "Error connecting to server")
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(tritonhttp.RECV_TIMEOUT))
+
+		_, err = io.WriteString(conn, "GET /flush HTTP/1.1\r\nHost: website1\r\n\r\n")
+		require.NoError(t, err, ErrSendingRequest)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err, ErrParsingResponse)
+		first := make([]byte, len("first "))
+		_, err = io.ReadFull(resp.Body, first)
+		require.NoError(t, err, "Flushed data should arrive before the handler returns")
+		assert.Equal(t, "first ", string(first))
+
+		close(proceed)
+		rest, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "Error reading response body")
+		assert.Equal(t, "second", string(rest))
+		assert.Equal(t, false, resp.Close, ErrConnectionHeaderMsg)
+	})
+
+	t.Run("Trailer", func(t *testing.T) {
+		req := "GET /trailer HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"Connection: close\r\n" +
+			"\r\n"
+
+		respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+		require.NoError(t, err, ErrSendingRequest)
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+		require.NoError(t, err, ErrParsingResponse)
+		assert.Equal(t, "", resp.Header.Get("X-Checksum"), "Trailer should not be sent as a header")
+		assert.Contains(t, resp.Trailer, "X-Checksum", "Trailer should be declared in the header")
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "Error reading response body")
+		assert.Equal(t, "payload", string(body))
+		assert.Equal(t, "321c3cf486ed509164edec1e1981fec8", resp.Trailer.Get("X-Checksum"))
+	})
+
+	t.Run("Aborted", func(t *testing.T) {
+		// A body cut short must not end with the last chunk, or the client
+		// would take it for the complete response
+		for _, target := range []string{"/panic", "/abort"} {
+			req := "GET " + target + " HTTP/1.1\r\n" +
+				"Host: website1\r\n" +
+				"\r\n"
+
+			respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+			require.NoError(t, err, ErrSendingRequest)
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			require.NoError(t, err, ErrParsingResponse)
+			assert.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+			body, err := io.ReadAll(resp.Body)
+			assert.ErrorIs(t, err, io.ErrUnexpectedEOF, "Body of %v should be cut off", target)
+			assert.Equal(t, "partial", string(body))
+		}
+	})
+
+	t.Run("Pipelined", func(t *testing.T) {
+		// An empty chunked body, a HEAD without chunks and a file must all
+		// be framed so each response starts where the previous one ended
+		req := "GET /empty HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"\r\n" +
+			"HEAD /trailer HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"\r\n" +
+			"GET /trailer HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"\r\n" +
+			"GET /index.html HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"Connection: close\r\n" +
+			"\r\n"
+
+		respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+		require.NoError(t, err, ErrSendingRequest)
+		respreader := bufio.NewReader(bytes.NewReader(respbytes))
+
+		for i, method := range []string{"GET", "HEAD", "GET", "GET"} {
+			resp, err := http.ReadResponse(respreader, &http.Request{Method: method})
+			require.NoError(t, err, "Error parsing the response %d", i+1)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err, "Error reading response body %d", i+1)
+			assert.Equal(t, 200, resp.StatusCode, "Response %d: %s", i+1, ErrStatusMsg)
+			switch i {
+			case 0, 1:
+				assert.Empty(t, body, "Response %d should have no body", i+1)
+			case 2:
+				assert.Equal(t, "payload", string(body))
+			}
+		}
+		_, err = respreader.ReadByte()
+		assert.ErrorIs(t, err, io.EOF, "Unexpected data after the last response")
+	})
+}
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+
+	send := func(t *testing.T, addr net.Addr, req string) {
+		host, port, err := net.SplitHostPort(addr.String())
+		require.NoError(t, err, "Error parsing listen address")
+		_, _, err = tritonhttp.Fetch(host, port, []byte(req))
+		require.NoError(t, err, ErrSendingRequest)
+	}
+	readLines := func(t *testing.T, path string) []string {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err, "Error reading access log")
+		return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	const indexSize = 377
+
+	t.Run("Entries", func(t *testing.T) {
+		t.Parallel()
+		entries := make(chan tritonhttp.AccessLogEntry, 10)
+		addr := servetritonhttpd(t, &tritonhttp.Server{
+			Addr:         "localhost:0",
+			VirtualHosts: tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs"),
+			AccessLog: tritonhttp.AccessLoggerFunc(func(entry tritonhttp.AccessLogEntry) {
+				entries <- entry
+			}),
+		})
+
+		before := time.Now()
+		send(t, addr, "GET /index.html?x=1 HTTP/1.1\r\nHost: website1:8080\r\nReferer: http://example.test/\r\nUser-Agent: gotest\r\n\r\n"+
+			"HEAD /index.html HTTP/1.1\r\nHost: website1\r\n\r\n"+
+			"GET /nope HTTP/1.1\r\nHost: unknown\r\n\r\n"+
+			"GET / HTTP/1.0\r\n\r\n")
+
+		entry := <-entries
+		assert.Equal(t, "GET", entry.Method)
+		assert.Equal(t, "/index.html?x=1", entry.RequestURI)
+		assert.Equal(t, "HTTP/1.1", entry.Protocol)
+		assert.Equal(t, "website1:8080", entry.Host)
+		assert.Equal(t, "website1", entry.VirtualHost)
+		assert.Equal(t, 200, entry.Status)
+		assert.Equal(t, int64(indexSize), entry.BytesSent)
+		assert.Equal(t, "http://example.test/", entry.Referer)
+		assert.Equal(t, "gotest", entry.UserAgent)
+		assert.True(t, strings.HasPrefix(entry.RemoteAddr, "127.0.0.1:"), "RemoteAddr mismatch: %v", entry.RemoteAddr)
+		assert.WithinDuration(t, before, entry.Time, time.Second)
+		assert.Greater(t, entry.Duration, time.Duration(0))
+
+		entry = <-entries
+		assert.Equal(t, "HEAD", entry.Method)
+		assert.Equal(t, 200, entry.Status)
+		assert.Equal(t, int64(0), entry.BytesSent, "HEAD sends no body")
+
+		entry = <-entries
+		assert.Equal(t, 404, entry.Status)
+		assert.Equal(t, "", entry.VirtualHost)
+		assert.Greater(t, entry.BytesSent, int64(0), "The error page should be counted")
+
+		entry = <-entries
+		assert.Equal(t, 400, entry.Status)
+		assert.Equal(t, "", entry.Method, "A malformed request has no method")
+	})
+
+	formats := []struct {
+		format   tritonhttp.AccessLogFormat
+		expected *regexp.Regexp
+	}{
+		{tritonhttp.LogFormatCommon, regexp.MustCompile(`^127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /index\.html HTTP/1\.1" 200 377$`)},
+		{tritonhttp.LogFormatCombined, regexp.MustCompile(`^127\.0\.0\.1 - - \[[^\]]+\] "GET /index\.html HTTP/1\.1" 200 377 "-" "evil\\" \\x0aagent"$`)},
+	}
+	for _, tt := range formats {
+		t.Run(string(tt.format), func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "access.log")
+			accessLog, err := tritonhttp.OpenAccessLog(path, tt.format)
+			require.NoError(t, err, "Error opening access log")
+			t.Cleanup(func() { accessLog.Close() })
+			addr := servetritonhttpd(t, &tritonhttp.Server{
+				Addr:         "localhost:0",
+				VirtualHosts: tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs"),
+				AccessLog:    accessLog,
+			})
+
+			// The quote and the encoded newline must not break the line
+			send(t, addr, "GET /index.html HTTP/1.1\r\nHost: website1\r\nUser-Agent: evil\" \nagent\r\nConnection: close\r\n\r\n")
+			lines := readLines(t, path)
+			require.Len(t, lines, 1)
+			assert.Regexp(t, tt.expected, lines[0])
+		})
+	}
+
+	t.Run("json", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "access.log")
+		accessLog, err := tritonhttp.OpenAccessLog(path, tritonhttp.LogFormatJSON)
+		require.NoError(t, err, "Error opening access log")
+		t.Cleanup(func() { accessLog.Close() })
+		addr := servetritonhttpd(t, &tritonhttp.Server{
+			Addr:         "localhost:0",
+			VirtualHosts: tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs"),
+			AccessLog:    accessLog,
+		})
+
+		send(t, addr, "GET /index.html HTTP/1.1\r\nHost: website1\r\nUser-Agent: gotest\r\nConnection: close\r\n\r\n")
+		lines := readLines(t, path)
+		require.Len(t, lines, 1)
+
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry), "Error decoding JSON entry")
+		assert.Equal(t, "GET", entry["method"])
+		assert.Equal(t, "/index.html", entry["uri"])
+		assert.Equal(t, "website1", entry["vhost"])
+		assert.Equal(t, float64(200), entry["status"])
+		assert.Equal(t, float64(indexSize), entry["bytes"])
+		assert.Equal(t, "gotest", entry["userAgent"])
+		assert.Contains(t, entry, "durationMs")
+		assert.Contains(t, entry, "time")
+	})
+
+	t.Run("Unknown Format", func(t *testing.T) {
+		_, err := tritonhttp.OpenAccessLog(filepath.Join(t.TempDir(), "access.log"), "apache")
+		assert.Error(t, err)
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		path := filepath.Join(dir, "access.log")
+		accessLog, err := tritonhttp.OpenAccessLog(path, tritonhttp.LogFormatCommon)
+		require.NoError(t, err, "Error opening access log")
+		t.Cleanup(func() { accessLog.Close() })
+		addr := servetritonhttpd(t, &tritonhttp.Server{
+			Addr:         "localhost:0",
+			VirtualHosts: tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs"),
+			AccessLog:    accessLog,
+		})
+
+		send(t, addr, "GET /index.html HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n")
+
+		// Like logrotate: move the log away, then have the server reopen it
+		require.NoError(t, os.Rename(path, path+".old"))
+		send(t, addr, "GET /before-reopen HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n")
+		require.NoError(t, accessLog.Reopen(), "Error reopening access log")
+		send(t, addr, "GET /after-reopen HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n")
+
+		old := readLines(t, path+".old")
+		require.Len(t, old, 2)
+		assert.Contains(t, old[1], "/before-reopen")
+		current := readLines(t, path)
+		require.Len(t, current, 1)
+		assert.Contains(t, current[0], "/after-reopen")
+	})
+
+	t.Run("Rotation", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		path := filepath.Join(dir, "access.log")
+		accessLog, err := tritonhttp.OpenAccessLog(path, tritonhttp.LogFormatCommon)
+		require.NoError(t, err, "Error opening access log")
+		t.Cleanup(func() { accessLog.Close() })
+		accessLog.MaxSize = 200
+		accessLog.MaxBackups = 2
+		addr := servetritonhttpd(t, &tritonhttp.Server{
+			Addr:         "localhost:0",
+			VirtualHosts: tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs"),
+			AccessLog:    accessLog,
+		})
+
+		// Each line is about 80 bytes, so every file holds two
+		for i := 0; i < 7; i++ {
+			send(t, addr, fmt.Sprintf("GET /index.html?n=%d HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n", i))
+		}
+
+		assert.Equal(t, []string{"n=6"}, grepLines(readLines(t, path), "n="))
+		assert.Equal(t, []string{"n=4", "n=5"}, grepLines(readLines(t, path+".1"), "n="))
+		assert.Equal(t, []string{"n=2", "n=3"}, grepLines(readLines(t, path+".2"), "n="))
+		assert.NoFileExists(t, path+".3", "Only MaxBackups files should be kept")
+	})
+
+	t.Run("Failed Rotation", func(t *testing.T) {
+		t.Parallel()
+		dir := filepath.Join(t.TempDir(), "logs")
+		require.NoError(t, os.Mkdir(dir, 0755))
+		path := filepath.Join(dir, "access.log")
+		accessLog, err := tritonhttp.OpenAccessLog(path, tritonhttp.LogFormatCommon)
+		require.NoError(t, err, "Error opening access log")
+		t.Cleanup(func() { accessLog.Close() })
+		accessLog.MaxSize = 1
+		logs := &syncBuffer{}
+		accessLog.Logger = slog.New(slog.NewJSONHandler(logs, nil))
+		logQuery := func(n string) {
+			accessLog.LogAccess(tritonhttp.AccessLogEntry{Method: "GET", RequestURI: "/index.html?n=" + n, Protocol: "HTTP/1.1", Status: 200})
+		}
+
+		// With the directory gone, rotating fails and entries are dropped
+		// until the log is reopened
+		logQuery("first")
+		require.NoError(t, os.RemoveAll(dir))
+		logQuery("lost")
+		require.NoError(t, os.Mkdir(dir, 0755))
+		require.NoError(t, accessLog.Reopen(), "Reopen should retry the file")
+		logQuery("after_reopen")
+		assert.Equal(t, []string{"n=after_reopen"}, grepLines(readLines(t, path), "n="))
+
+		// Logging also resumes by itself once the file can be opened again
+		require.NoError(t, os.RemoveAll(dir))
+		logQuery("lost")
+		require.NoError(t, os.Mkdir(dir, 0755))
+		logQuery("recovered")
+		assert.Equal(t, []string{"n=recovered"}, grepLines(readLines(t, path), "n="))
+
+		var msgs []any
+		for _, record := range logs.records(t) {
+			msgs = append(msgs, record["msg"])
+		}
+		assert.Contains(t, msgs, "Error reopening access log after rotation", "Failures should go to the logger of the access log")
+	})
+}
+
+// grepLines returns the word starting with prefix in each line.
+func grepLines(lines []string, prefix string) []string {
+	var words []string
+	re := regexp.MustCompile(regexp.QuoteMeta(prefix) + `\w+`)
+	for _, line := range lines {
+		if word := re.FindString(line); word != "" {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// syncBuffer is a bytes.Buffer that can be written from several goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records decodes the JSON log lines written so far.
+func (b *syncBuffer) records(t *testing.T) []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]any
+	dec := json.NewDecoder(bytes.NewReader(b.buf.Bytes()))
+	for dec.More() {
+		var record map[string]any
+		require.NoError(t, dec.Decode(&record), "Error decoding log record")
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestLogging(t *testing.T) {
+	t.Parallel()
+
+	serve := func(t *testing.T, level slog.Level) (net.Addr, *syncBuffer) {
+		logs := &syncBuffer{}
+		addr := servetritonhttpd(t, &tritonhttp.Server{
+			Addr:         "localhost:0",
+			VirtualHosts: tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs"),
+			Logger:       slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: level})),
+			Handler: tritonhttp.HandlerFunc(func(w tritonhttp.ResponseWriter, r *tritonhttp.Request) {
+				r.Logger().Info("Handled", "url", r.URL)
+				w.Header()["Content-Length"] = "2"
+				w.WriteHeader(tritonhttp.StatusOK)
+				w.Write([]byte("ok"))
+			}),
+		})
+		return addr, logs
+	}
+	send := func(t *testing.T, addr net.Addr, req string) {
+		host, port, err := net.SplitHostPort(addr.String())
+		require.NoError(t, err, "Error parsing listen address")
+		_, _, err = tritonhttp.Fetch(host, port, []byte(req))
+		require.NoError(t, err, ErrSendingRequest)
+	}
+	withMsg := func(records []map[string]any, msg string) []map[string]any {
+		var matching []map[string]any
+		for _, record := range records {
+			if record["msg"] == msg {
+				matching = append(matching, record)
+			}
+		}
+		return matching
+	}
+
+	t.Run("Connection IDs", func(t *testing.T) {
+		t.Parallel()
+		addr, logs := serve(t, slog.LevelDebug)
+
+		send(t, addr, "GET /a HTTP/1.1\r\nHost: website1\r\n\r\n"+
+			"GET /b HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n")
+		send(t, addr, "GET /c HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n")
+
+		records := logs.records(t)
+		handled := withMsg(records, "Handled")
+		require.Len(t, handled, 3)
+		assert.Equal(t, "/a", handled[0]["url"])
+		assert.Equal(t, "/b", handled[1]["url"])
+		assert.Equal(t, "/c", handled[2]["url"])
+
+		// Requests on the same connection share its ID and are numbered
+		assert.Equal(t, handled[0]["conn"], handled[1]["conn"])
+		assert.NotEqual(t, handled[0]["conn"], handled[2]["conn"])
+		assert.Equal(t, float64(1), handled[0]["req"])
+		assert.Equal(t, float64(2), handled[1]["req"])
+		assert.Equal(t, float64(1), handled[2]["req"])
+		for _, record := range handled {
+			assert.True(t, strings.HasPrefix(record["remote"].(string), "127.0.0.1:"), "Missing remote address: %v", record)
+		}
+
+		accepted := withMsg(records, "Accepted connection")
+		require.Len(t, accepted, 2)
+		assert.Equal(t, "DEBUG", accepted[0]["level"])
+		assert.NotContains(t, accepted[0], "req", "The connection is logged before any request")
+		assert.Len(t, withMsg(records, "Closing connection"), 2)
+	})
+
+	t.Run("Level", func(t *testing.T) {
+		t.Parallel()
+		addr, logs := serve(t, slog.LevelInfo)
+
+		send(t, addr, "GET /a HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n")
+		send(t, addr, "GET /bad\r\n\r\n")
+
+		records := logs.records(t)
+		assert.Len(t, withMsg(records, "Handled"), 1)
+		assert.Len(t, withMsg(records, "Bad request"), 1)
+		for _, record := range records {
+			assert.NotEqual(t, "DEBUG", record["level"], "Debug records should be dropped: %v", record)
+		}
+	})
+}
+
+// scrapeMetrics fetches the metrics served at addr and returns the value of
+// each series, keyed by its name and labels as written.
+func scrapeMetrics(t *testing.T, addr net.Addr) map[string]float64 {
+	resp, body := fetchFrom(t, addr.String(), "GET", "admin", "/metrics", "")
+	require.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	series := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSuffix(string(body), "\n"), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		require.Greater(t, i, 0, "Malformed metrics line %q", line)
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		require.NoError(t, err, "Malformed metrics value in %q", line)
+		series[line[:i]] = value
+	}
+	return series
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	metrics := tritonhttp.NewMetrics()
+	addr := servetritonhttpd(t, &tritonhttp.Server{
+		Addr:         "localhost:0",
+		VirtualHosts: tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs"),
+		Metrics:      metrics,
+	})
+	adminAddr := servetritonhttpd(t, &tritonhttp.Server{
+		Addr:    "localhost:0",
+		Handler: metrics,
+	})
+	host, port, err := net.SplitHostPort(addr.String())
+	require.NoError(t, err, "Error parsing listen address")
+
+	_, notFound := fetchFrom(t, addr.String(), "GET", "website1", "/nope", "")
+	_, _, err = tritonhttp.Fetch(host, port, []byte("GET /index.html HTTP/1.1\r\nHost: website1\r\n\r\n"+
+		"HEAD /index.html HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err, ErrSendingRequest)
+	fetchFrom(t, addr.String(), "GET", "unknown", "/", "")
+	_, _, err = tritonhttp.Fetch(host, port, []byte("GET /bad\r\n\r\n"))
+	require.NoError(t, err, ErrSendingRequest)
+	_, _, err = tritonhttp.Fetch(host, port, []byte("GET / HTTP/1.1\r\n"))
+	require.NoError(t, err, ErrSendingRequest)
+
+	// Leave a connection open and idle after one request
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err, "Error connecting")
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /index.html HTTP/1.1\r\nHost: website2\r\n\r\n"))
+	require.NoError(t, err, ErrSendingRequest)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err, ErrParsingResponse)
+	_, err = io.Copy(io.Discard, resp.Body)
+	require.NoError(t, err, "Error reading response body")
+
+	require.Eventually(t, func() bool {
+		return scrapeMetrics(t, adminAddr)[`tritonhttp_connections{state="idle"}`] == 1
+	}, time.Second, 10*time.Millisecond, "The open connection should be idle")
+
+	series := scrapeMetrics(t, adminAddr)
+	assert.Equal(t, 1.0, series[`tritonhttp_requests_total{vhost="website1",method="GET",status="200"}`])
+	assert.Equal(t, 1.0, series[`tritonhttp_requests_total{vhost="website1",method="GET",status="404"}`])
+	assert.Equal(t, 1.0, series[`tritonhttp_requests_total{vhost="website1",method="HEAD",status="200"}`])
+	assert.Equal(t, 1.0, series[`tritonhttp_requests_total{vhost="",method="GET",status="404"}`])
+	assert.Equal(t, 1.0, series[`tritonhttp_requests_total{vhost="website2",method="GET",status="200"}`])
+	assert.Equal(t, float64(377+len(notFound)), series[`tritonhttp_response_bytes_total{vhost="website1"}`])
+
+	assert.Equal(t, 3.0, series[`tritonhttp_request_duration_seconds_count{vhost="website1"}`])
+	assert.Equal(t, 3.0, series[`tritonhttp_request_duration_seconds_bucket{vhost="website1",le="+Inf"}`])
+	assert.Equal(t, 3.0, series[`tritonhttp_request_duration_seconds_bucket{vhost="website1",le="10"}`])
+	assert.Contains(t, series, `tritonhttp_request_duration_seconds_sum{vhost="website1"}`)
+
+	assert.Equal(t, 6.0, series["tritonhttp_connections_accepted_total"])
+	assert.Equal(t, 0.0, series[`tritonhttp_connections{state="active"}`])
+	assert.Equal(t, 1.0, series[`tritonhttp_parse_errors_total{status="400"}`])
+	assert.Equal(t, 1.0, series[`tritonhttp_timeouts_total{phase="request"}`])
+	assert.Contains(t, series, `tritonhttp_timeouts_total{phase="idle"}`)
+
+	t.Run("Other Paths", func(t *testing.T) {
+		resp, _ := fetchFrom(t, adminAddr.String(), "GET", "admin", "/", "")
+		assert.Equal(t, 404, resp.StatusCode, ErrStatusMsg)
+	})
+}
+
+// writeSelfSignedCert writes a self-signed certificate for host to dir,
+// adds it to pool and returns the paths of the certificate and its key.
+func writeSelfSignedCert(t *testing.T, dir string, host string, pool *x509.CertPool) (string, string) {
+	certPEM, keyPEM, err := tritonhttp.GenerateSelfSignedCert(host)
+	require.NoError(t, err, "Error generating certificate")
+	require.True(t, pool.AppendCertsFromPEM(certPEM), "Error adding certificate to pool")
+
+	certFile := filepath.Join(dir, host+".crt")
+	keyFile := filepath.Join(dir, host+".key")
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0644))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+	return certFile, keyFile
+}
+
+// fetchTLS sends req over a TLS connection to addr for serverName and
+// returns the response, its body and the certificate the server presented.
+func fetchTLS(t *testing.T, addr string, serverName string, pool *x509.CertPool, req string) (*http.Response, []byte, *x509.Certificate) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, RootCAs: pool})
+	require.NoError(t, err, "Error during TLS handshake")
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(req))
+	require.NoError(t, err, ErrSendingRequest)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err, ErrParsingResponse)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err, "Error reading response body")
+	return resp, body, conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestTLS(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	pool := x509.NewCertPool()
+	virtualHosts := tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")
+	for _, host := range []string{"website1", "website2"} {
+		vhost := virtualHosts[host]
+		vhost.CertFile, vhost.KeyFile = writeSelfSignedCert(t, dir, host, pool)
+		virtualHosts[host] = vhost
+	}
+
+	tlsLn, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err, "Error listening")
+	s := &tritonhttp.Server{
+		Addr:            "localhost:0",
+		TLSAddr:         tlsLn.Addr().String(),
+		VirtualHosts:    virtualHosts,
+		RedirectToHTTPS: true,
+	}
+	addr := servetritonhttpd(t, s)
+	go s.ServeTLS(tlsLn)
+	tlsAddr := tlsLn.Addr().String()
+
+	t.Run("SNI", func(t *testing.T) {
+		for _, host := range []string{"website1", "website2"} {
+			resp, body, cert := fetchTLS(t, tlsAddr, host, pool,
+				"GET /index.html HTTP/1.1\r\nHost: "+host+"\r\nConnection: close\r\n\r\n")
+			assert.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+			assert.NotEmpty(t, body)
+			assert.Equal(t, []string{host}, cert.DNSNames, "The certificate should match the server name")
+		}
+	})
+
+	t.Run("Keep-Alive", func(t *testing.T) {
+		resp, _, _ := fetchTLS(t, tlsAddr, "website1", pool,
+			"HEAD /index.html HTTP/1.1\r\nHost: website1\r\n\r\n"+
+				"GET /index.html HTTP/1.1\r\nHost: website1:443\r\nConnection: close\r\n\r\n")
+		assert.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+		assert.False(t, resp.Close, "The first response should keep the connection open")
+	})
+
+	t.Run("Misdirected", func(t *testing.T) {
+		resp, body, _ := fetchTLS(t, tlsAddr, "website1", pool,
+			"GET /index.html HTTP/1.1\r\nHost: website2\r\n\r\n")
+		assert.Equal(t, "421 Misdirected Request", resp.Status, ErrStatusMsg)
+		assert.True(t, resp.Close, ErrConnectionHeaderMsg)
+		assert.Contains(t, string(body), "421 Misdirected Request")
+	})
+
+	t.Run("Unknown Server Name", func(t *testing.T) {
+		_, err := tls.Dial("tcp", tlsAddr, &tls.Config{ServerName: "website3", RootCAs: pool})
+		assert.Error(t, err, "No certificate should be offered for a host without one")
+	})
+
+	t.Run("Redirect To HTTPS", func(t *testing.T) {
+		_, tlsPort, err := net.SplitHostPort(tlsAddr)
+		require.NoError(t, err, "Error parsing listen address")
+
+		resp, body := fetchFrom(t, addr.String(), "GET", "website1:8080", "/subdir/a%20b.html?v=1", "")
+		assert.Equal(t, 301, resp.StatusCode, ErrStatusMsg)
+		assert.Equal(t, "https://website1:"+tlsPort+"/subdir/a%20b.html?v=1", resp.Header.Get("Location"))
+		assert.Empty(t, body)
+	})
+
+	t.Run("No Certificates", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err, "Error listening")
+		s := &tritonhttp.Server{VirtualHosts: tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")}
+		assert.ErrorContains(t, s.ServeTLS(ln), "no virtual host has a certificate")
+	})
+}
+
+func TestReloadVirtualHosts(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for _, site := range []string{"a", "b"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, site), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, site, "index.html"), []byte("site "+site), 0644))
+	}
+	configPath := filepath.Join(dir, "virtual_hosts.yaml")
+	writeConfig := func(t *testing.T, config string) {
+		require.NoError(t, os.WriteFile(configPath, []byte(config), 0644))
+	}
+
+	writeConfig(t, "virtual_hosts:\n  - hostName: website1\n    docRoot: a\n")
+	virtualHosts, err := tritonhttp.LoadVHConfigFile(configPath, dir)
+	require.NoError(t, err, "Error loading config")
+	s := &tritonhttp.Server{
+		Addr:         "localhost:0",
+		VirtualHosts: virtualHosts,
+	}
+	addr := servetritonhttpd(t, s)
+
+	// A keep-alive connection opened before the reload
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err, "Error connecting")
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	get := func(t *testing.T, host string) (int, string) {
+		_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+		require.NoError(t, err, ErrSendingRequest)
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err, ErrParsingResponse)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "Error reading response body")
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get(t, "website1")
+	assert.Equal(t, 200, status, ErrStatusMsg)
+	assert.Equal(t, "site a", body)
+	status, _ = get(t, "website2")
+	assert.Equal(t, 404, status, ErrStatusMsg)
+
+	writeConfig(t, "virtual_hosts:\n  - hostName: website1\n    docRoot: b\n  - hostName: website2\n    docRoot: a\n")
+	virtualHosts, err = tritonhttp.LoadVHConfigFile(configPath, dir)
+	require.NoError(t, err, "Error loading config")
+	require.NoError(t, s.SetVirtualHosts(virtualHosts), "Error swapping virtual hosts")
+
+	status, body = get(t, "website1")
+	assert.Equal(t, 200, status, ErrStatusMsg)
+	assert.Equal(t, "site b", body, "The open connection should use the new config")
+	status, body = get(t, "website2")
+	assert.Equal(t, 200, status, ErrStatusMsg)
+	assert.Equal(t, "site a", body)
+
+	t.Run("Invalid Config", func(t *testing.T) {
+		for name, config := range map[string]string{
+			"Malformed YAML":  "virtual_hosts: [\n",
+			"Missing Docroot": "virtual_hosts:\n  - hostName: website1\n    docRoot: missing\n",
+			"Bad Option":      "virtual_hosts:\n  - hostName: website1\n    docRoot: a\n    symlinks: sometimes\n",
+		} {
+			writeConfig(t, config)
+			_, err := tritonhttp.LoadVHConfigFile(configPath, dir)
+			assert.Error(t, err, name)
+		}
+
+		err := s.SetVirtualHosts(map[string]tritonhttp.VirtualHost{
+			"website1": {HostName: "website1", DocRoot: filepath.Join(dir, "missing")},
+		})
+		assert.Error(t, err, "A missing docroot should be rejected")
+
+		status, body := get(t, "website1")
+		assert.Equal(t, 200, status, ErrStatusMsg)
+		assert.Equal(t, "site b", body, "The old config should keep running")
+	})
+
+	t.Run("Concurrent Swaps", func(t *testing.T) {
+		configs := []map[string]tritonhttp.VirtualHost{
+			{"website1": {HostName: "website1", DocRoot: filepath.Join(dir, "a")}},
+			{"website1": {HostName: "website1", DocRoot: filepath.Join(dir, "b")}},
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				assert.NoError(t, s.SetVirtualHosts(configs[i%2]))
+			}
+		}()
+		for i := 0; i < 20; i++ {
+			status, body := get(t, "website1")
+			assert.Equal(t, 200, status, ErrStatusMsg)
+			assert.Contains(t, []string{"site a", "site b"}, body)
+		}
+		<-done
+	})
+}
+
+func TestWatchFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "virtual_hosts.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("virtual_hosts: []\n"), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 10)
+	go watchFile(ctx, path, 10*time.Millisecond, func() { changed <- struct{}{} })
+
+	select {
+	case <-changed:
+		t.Fatal("Reported a change before the file changed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte("virtual_hosts:\n  - hostName: website1\n"), 0644))
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("The change was not reported")
+	}
+}
+
+func TestLoadVHConfigFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "site"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), nil, 0644))
+	load := func(t *testing.T, config string) (map[string]tritonhttp.VirtualHost, error) {
+		path := filepath.Join(t.TempDir(), "virtual_hosts.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(config), 0644))
+		return tritonhttp.LoadVHConfigFile(path, dir)
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		vhosts, err := load(t, "virtual_hosts:\n  - hostName: website1\n    docRoot: site\n")
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(dir, "site"), vhosts["website1"].DocRoot)
+	})
+
+	t.Run("Every Problem", func(t *testing.T) {
+		_, err := load(t, "virtual_hosts:\n"+
+			"  - hostName: website1\n    docRoot: site\n    unknownKey: 1\n"+
+			"  - hostName: WEBSITE1\n    docRoot: site\n"+
+			"  - hostName: website2\n    docRoot: missing\n"+
+			"  - hostName: website3\n    docRoot: file\n    symlinks: sometimes\n    compression:\n      level: 42\n"+
+			"  - docRoot: site\n"+
+			"  - hostName: website4\n    docRoot: site\n    certFile: website4.crt\n")
+
+		var configErr *tritonhttp.ConfigError
+		require.ErrorAs(t, err, &configErr)
+		assert.True(t, strings.HasSuffix(configErr.Path, "virtual_hosts.yaml"))
+
+		var problems []string
+		for _, p := range configErr.Problems {
+			problems = append(problems, p.Error())
+		}
+		expected := []string{
+			"line 4: field unknownKey not found",
+			`virtual host "WEBSITE1": duplicate hostName, already used by virtual host 0`,
+			`virtual host "website2": docroot ` + filepath.Join(dir, "missing") + " does not exist",
+			`virtual host "website3": docroot ` + filepath.Join(dir, "file") + " is not a directory",
+			`virtual host "website3": invalid symlinks policy "sometimes"`,
+			`virtual host "website3": invalid compression settings`,
+			"virtual host 4: empty hostName",
+			`virtual host "website4": needs both certFile and keyFile`,
+		}
+		require.Len(t, problems, len(expected), "Problems: %q", problems)
+		for i := range expected {
+			assert.Contains(t, problems[i], expected[i])
+		}
+		assert.ErrorIs(t, err, os.ErrNotExist, "The problems should be unwrappable")
+		assert.Contains(t, err.Error(), "8 problems")
+	})
+
+	t.Run("Malformed YAML", func(t *testing.T) {
+		_, err := load(t, "virtual_hosts: [\n")
+		var configErr *tritonhttp.ConfigError
+		assert.Error(t, err)
+		assert.False(t, errors.As(err, &configErr), "A syntax error stops parsing")
+	})
+
+	t.Run("Missing File", func(t *testing.T) {
+		_, err := tritonhttp.LoadVHConfigFile(filepath.Join(dir, "missing.yaml"), dir)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("Serve", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err, "Error listening")
+		s := &tritonhttp.Server{VirtualHosts: map[string]tritonhttp.VirtualHost{
+			"website1": {DocRoot: filepath.Join(dir, "file"), Symlinks: "sometimes"},
+		}}
+		err = s.Serve(ln)
+		var configErr *tritonhttp.ConfigError
+		require.ErrorAs(t, err, &configErr)
+		assert.Len(t, configErr.Problems, 2)
+		assert.Equal(t, "website1", configErr.Problems[0].HostName)
+	})
+}
+
+func TestCheckConfig(t *testing.T) {
+	t.Parallel()
+
+	check := func(t *testing.T, args ...string) error {
+		args = append([]string{"-vh_config", "../../virtual_hosts.yaml"}, args...)
+		opts, err := parseOptions(flag.NewFlagSet("tritonhttpd", flag.ContinueOnError), args, noEnv)
+		require.NoError(t, err, "Error parsing options")
+		return checkConfig(opts.vhConfigPath, opts.server)
+	}
+	assert.NoError(t, check(t))
+	assert.ErrorContains(t, check(t, "-docroot", "/nonexistent"), "does not exist")
+	assert.ErrorContains(t, check(t, "-tls_port", "8443"), "no virtual host")
+	assert.ErrorContains(t, check(t, "-tls_addr", "localhost:8443"), "no virtual host")
+	assert.NoError(t, check(t, "-addr", "127.0.0.1:8080"))
+	assert.ErrorContains(t, check(t, "-addr", "8080"), `invalid addr "8080"`)
+	assert.ErrorContains(t, check(t, "-tls_addr", "localhost:https"), `invalid tlsAddr "localhost:https"`)
+	assert.ErrorContains(t, check(t, "-redirect_https"), "redirectHTTPS needs tlsPort")
+	assert.ErrorContains(t, check(t, "-access_log_format", "apache"), "access log format")
+
+	err := check(t, "-read_header_timeout", "-1s", "-log_level", "loud", "-docroot", "/nonexistent")
+	assert.ErrorContains(t, err, "negative readHeader timeout")
+	assert.ErrorContains(t, err, `invalid log level "loud"`)
+	assert.ErrorContains(t, err, "does not exist", "Server and virtual host problems are reported together")
+}
+
+// noEnv is a lookupEnv for parseOptions with an empty environment.
+func noEnv(string) (string, bool) {
+	return "", false
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sites"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sites", "site"), 0755))
+	configPath := filepath.Join(dir, "tritonhttpd.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte("server:\n"+
+		"  port: 9001\n"+
+		"  docroot: sites\n"+
+		"  metricsAddr: localhost:9100\n"+
+		"  timeouts:\n    read: 1s\n    write: 2s\n    idle: 3s\n    shutdown: 3s\n"+
+		"  limits:\n    maxBodyBytes: 100\n"+
+		"  log:\n    level: warn\n    accessLog: access.log\n"+
+		"virtual_hosts:\n  - hostName: website1\n    docRoot: site\n"+
+		"    headers: {X-Frame-Options: DENY}\n    caching: {maxAge: 1h}\n"+
+		"  - hostName: website2\n    docRoot: site\n"), 0644))
+
+	env := map[string]string{
+		"TRITONHTTPD_VH_CONFIG":        configPath,
+		"TRITONHTTPD_SHUTDOWN_TIMEOUT": "20s",
+		"TRITONHTTPD_WRITE_TIMEOUT":    "20s",
+		"TRITONHTTPD_IDLE_TIMEOUT":     "30s",
+		"TRITONHTTPD_METRICS_ADDR":     "localhost:9200",
+		"TRITONHTTPD_MAX_BODY_BYTES":   "500",
+		"TRITONHTTPD_LOG_FORMAT":       "json",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	opts, err := parseOptions(flag.NewFlagSet("tritonhttpd", flag.ContinueOnError), []string{"-metrics_addr", "localhost:9300", "-max_body_bytes=1000", "-idle_timeout", "300s"}, lookupEnv)
+	require.NoError(t, err, "Error parsing options")
+	cfg := opts.server
+
+	assert.Equal(t, configPath, opts.vhConfigPath, "The config file can be named by the environment")
+	assert.Equal(t, 9001, cfg.Port, "File over default")
+	assert.Equal(t, filepath.Join(dir, "sites"), cfg.Docroot, "Paths in the file are relative to it")
+	assert.Equal(t, filepath.Join(dir, "access.log"), cfg.Log.AccessLog, "Paths in the file are relative to it")
+	assert.Equal(t, "localhost:9300", cfg.MetricsAddr, "Flag over environment and file")
+	assert.Equal(t, 20*time.Second, cfg.Timeouts.Shutdown, "Environment over file")
+	assert.Equal(t, time.Second, cfg.Timeouts.Read, "File over default")
+	assert.Equal(t, tritonhttp.READ_HEADER_TIMEOUT, cfg.Timeouts.ReadHeader, "Default")
+	assert.Equal(t, 20*time.Second, cfg.Timeouts.Write, "Environment over file")
+	assert.Equal(t, 300*time.Second, cfg.Timeouts.Idle, "Flag over environment and file")
+	assert.Equal(t, int64(1000), cfg.Limits.MaxBodyBytes, "Flag over environment and file")
+	assert.Equal(t, time.Duration(0), cfg.WatchInterval, "Default")
+	assert.Equal(t, "warn", cfg.Log.Level, "File over default")
+	assert.Equal(t, "json", cfg.Log.Format, "Environment over default")
+	assert.Equal(t, tritonhttp.LogFormatCombined, cfg.Log.AccessLogFormat, "Default")
+
+	t.Run("Listen Addresses", func(t *testing.T) {
+		assert.Equal(t, ":9001", cfg.ListenAddr(), "Port on every interface")
+		assert.Equal(t, "", cfg.TLSListenAddr(), "HTTPS disabled")
+
+		env := map[string]string{"TRITONHTTPD_ADDR": "127.0.0.1:9002"}
+		lookupEnv := func(name string) (string, bool) {
+			value, ok := env[name]
+			return value, ok
+		}
+		opts, err := parseOptions(flag.NewFlagSet("tritonhttpd", flag.ContinueOnError), []string{"-vh_config", configPath, "-tls_addr", "localhost:9443"}, lookupEnv)
+		require.NoError(t, err, "Error parsing options")
+		assert.Equal(t, "127.0.0.1:9002", opts.server.ListenAddr(), "Address over port")
+		assert.Equal(t, "localhost:9443", opts.server.TLSListenAddr(), "Address enables HTTPS")
+	})
+
+	t.Run("Actions Not From Environment", func(t *testing.T) {
+		env := map[string]string{"TRITONHTTPD_CHECK": "true", "TRITONHTTPD_PRINT_CONFIG": "true"}
+		lookupEnv := func(name string) (string, bool) {
+			value, ok := env[name]
+			return value, ok
+		}
+		opts, err := parseOptions(flag.NewFlagSet("tritonhttpd", flag.ContinueOnError), []string{"-vh_config", configPath}, lookupEnv)
+		require.NoError(t, err, "Error parsing options")
+		assert.False(t, opts.check, "Only the command line asks for -check")
+		assert.False(t, opts.printConfig, "Only the command line asks for -print-config")
+	})
+
+	t.Run("Print Config", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, printConfig(&out, opts.vhConfigPath, cfg))
+		printed := out.String()
+		for _, expected := range []string{
+			"server:\n  port: 9001\n",
+			"  metricsAddr: localhost:9300\n",
+			"    idle: 5m0s\n",
+			"    shutdown: 20s\n",
+			"    maxBodyBytes: 1000\n",
+			"    format: json\n",
+			"- hostName: website1\n",
+			"    X-Frame-Options: DENY\n",
+			"    maxAge: 1h0m0s\n",
+		} {
+			assert.Contains(t, printed, expected)
+		}
+
+		// The printed server section reads back to the same settings
+		reprinted := filepath.Join(t.TempDir(), "printed.yaml")
+		require.NoError(t, os.WriteFile(reprinted, out.Bytes(), 0644))
+		var reread tritonhttp.ServerConfig
+		require.NoError(t, tritonhttp.LoadServerConfig(reprinted, &reread))
+		assert.Equal(t, cfg, reread)
+
+		// And the virtual hosts to the same ones, wherever it is saved
+		virtualHosts, err := tritonhttp.LoadVHConfigFile(configPath, cfg.Docroot)
+		require.NoError(t, err, "Error loading virtual hosts")
+		rereadHosts, err := tritonhttp.LoadVHConfigFile(reprinted, reread.Docroot)
+		require.NoError(t, err, "Printed virtual hosts should load")
+		assert.Equal(t, virtualHosts, rereadHosts)
+		assert.Equal(t, filepath.Join(dir, "sites", "site"), rereadHosts["website1"].DocRoot)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		env["TRITONHTTPD_PORT"] = "http"
+		defer delete(env, "TRITONHTTPD_PORT")
+		_, err := parseOptions(flag.NewFlagSet("tritonhttpd", flag.ContinueOnError), nil, lookupEnv)
+		assert.ErrorContains(t, err, "TRITONHTTPD_PORT")
+
+		badConfig := filepath.Join(t.TempDir(), "bad.yaml")
+		require.NoError(t, os.WriteFile(badConfig, []byte("server:\n  port: http\n  timeout: 1s\n"), 0644))
+		_, err = parseOptions(flag.NewFlagSet("tritonhttpd", flag.ContinueOnError), []string{"-vh_config", badConfig}, noEnv)
+		var configErr *tritonhttp.ConfigError
+		require.ErrorAs(t, err, &configErr)
+		assert.Len(t, configErr.Problems, 2, "Problems: %v", configErr.Problems)
+	})
+}
+
+func TestVirtualHostHeadersAndCaching(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for _, name := range []string{"index.html", "app.js", "logo.png", "data.bin"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("content of "+name), 0644))
+	}
+	s := &tritonhttp.Server{
+		Addr: "localhost:0",
+		VirtualHosts: map[string]tritonhttp.VirtualHost{
+			"cached": {
+				DocRoot: dir,
+				Headers: map[string]string{"x-frame-options": "DENY", "Cache-Control": "private"},
+				Caching: tritonhttp.CachingConfig{
+					MaxAge:    time.Hour,
+					Types:     map[string]time.Duration{"text/html": 0, "image/*": 24 * time.Hour},
+					Immutable: true,
+				},
+			},
+			"plain": {DocRoot: dir},
+		},
+	}
+	addr := servetritonhttpd(t, s)
+
+	tests := []struct {
+		name                 string
+		host                 string
+		target               string
+		expectedStatus       int
+		expectedCacheControl string
+	}{
+		{"Media Type", "cached", "/index.html", 200, "no-cache"},
+		{"Wildcard Media Type", "cached", "/logo.png", 200, "max-age=86400, immutable"},
+		{"Default Max Age", "cached", "/app.js", 200, "max-age=3600, immutable"},
+		{"Other Files", "cached", "/data.bin", 200, "max-age=3600, immutable"},
+		{"Error Keeps Configured Header", "cached", "/missing", 404, "private"},
+		{"No Caching", "plain", "/app.js", 200, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, _ := fetchFrom(t, addr.String(), "GET", tt.host, tt.target, "")
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode, ErrStatusMsg)
+			assert.Equal(t, tt.expectedCacheControl, resp.Header.Get("Cache-Control"))
+			if tt.host == "cached" {
+				assert.Equal(t, "DENY", resp.Header.Get("X-Frame-Options"))
+			} else {
+				assert.Empty(t, resp.Header.Get("X-Frame-Options"))
+			}
+		})
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		for name, vhost := range map[string]tritonhttp.VirtualHost{
+			"Framing Header":   {DocRoot: dir, Headers: map[string]string{"content-length": "1"}},
+			"Bad Header Name":  {DocRoot: dir, Headers: map[string]string{"X Frame": "DENY"}},
+			"Bad Header Value": {DocRoot: dir, Headers: map[string]string{"X-Frame-Options": "DENY\r\nX-Injected: 1"}},
+			"Negative Max Age": {DocRoot: dir, Caching: tritonhttp.CachingConfig{MaxAge: -time.Second}},
+			"Bad Media Type":   {DocRoot: dir, Caching: tritonhttp.CachingConfig{Types: map[string]time.Duration{"html": 0}}},
+		} {
+			t.Run(name, func(t *testing.T) {
+				s := &tritonhttp.Server{}
+				assert.Error(t, s.SetVirtualHosts(map[string]tritonhttp.VirtualHost{"website1": vhost}))
+			})
+		}
+	})
+}
+
+func TestServerTimeouts(t *testing.T) {
+	t.Parallel()
+
+	const bigBodySize = 64 << 20
+	big := tritonhttp.HandlerFunc(func(w tritonhttp.ResponseWriter, r *tritonhttp.Request) {
+		if r.URL != "/big" {
+			tritonhttp.FileHandler{}.ServeTriton(w, r)
+			return
+		}
+		w.Header()["Content-Length"] = strconv.Itoa(bigBodySize)
+		chunk := make([]byte, 1<<20)
+		for i := 0; i < bigBodySize/len(chunk); i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	})
+	s := &tritonhttp.Server{
+		Addr:              "localhost:0",
+		VirtualHosts:      tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs"),
+		Handler:           big,
+		ReadTimeout:       time.Second,
+		ReadHeaderTimeout: 1500 * time.Millisecond,
+		IdleTimeout:       2200 * time.Millisecond,
+		WriteTimeout:      500 * time.Millisecond,
+	}
+	addr := servetritonhttpd(t, s)
+
+	t.Run("Keep-Alive Header", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err, "Error connecting")
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+
+		_, err = fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: website1\r\n\r\n")
+		require.NoError(t, err, ErrSendingRequest)
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err, ErrParsingResponse)
+		io.Copy(io.Discard, resp.Body)
+		assert.Equal(t, "timeout=2", resp.Header.Get("Keep-Alive"), "The idle timeout should be advertised in whole seconds")
+
+		_, err = fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n")
+		require.NoError(t, err, ErrSendingRequest)
+		resp, err = http.ReadResponse(br, nil)
+		require.NoError(t, err, ErrParsingResponse)
+		assert.Empty(t, resp.Header.Get("Keep-Alive"), "A closing connection should not advertise a timeout")
+	})
+
+	t.Run("Idle", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err, "Error connecting")
+		defer conn.Close()
+		start := time.Now()
+		_, err = conn.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF, "The idle connection should be closed")
+		assert.Greater(t, time.Since(start), 2*time.Second, "The idle timeout should apply, not the read timeout")
+	})
+
+	t.Run("Read Header", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err, "Error connecting")
+		defer conn.Close()
+
+		// A byte every half second never trips the read timeout, but the
+		// headers as a whole take too long
+		start := time.Now()
+		go func() {
+			fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: website1\r\n")
+			for i := 0; i < 10; i++ {
+				time.Sleep(500 * time.Millisecond)
+				if _, err := fmt.Fprint(conn, "X"); err != nil {
+					return
+				}
+			}
+		}()
+		response, err := bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err, "Failed to read response")
+		assert.Contains(t, response, "HTTP/1.1 400 Bad Request")
+		assert.Less(t, time.Since(start), 2500*time.Millisecond, "The header timeout should cut the request short")
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err, "Error connecting")
+		defer conn.Close()
+
+		// A client that stops reading the response is cut off
+		_, err = fmt.Fprint(conn, "GET /big HTTP/1.1\r\nHost: website1\r\n\r\n")
+		require.NoError(t, err, ErrSendingRequest)
+		time.Sleep(time.Second)
+		n, _ := io.Copy(io.Discard, conn)
+		assert.Less(t, n, int64(bigBodySize), "The response should have been cut off")
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err, "Error connecting")
+		defer conn.Close()
+
+		// Bytes arriving within the read timeout keep the request alive
+		for _, part := range []string{"GET / HTTP/1.1\r\n", "Host: website1\r\n", "Connection: close\r\n", "\r\n"} {
+			_, err := conn.Write([]byte(part))
+			require.NoError(t, err, ErrSendingRequest)
+			time.Sleep(300 * time.Millisecond)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err, ErrParsingResponse)
+		assert.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+	})
+}
+
+func TestRequestBody(t *testing.T) {
+	t.Parallel()
+
+	echo := tritonhttp.HandlerFunc(func(w tritonhttp.ResponseWriter, r *tritonhttp.Request) {
+		if r.URL != "/echo" {
+			tritonhttp.FileHandler{}.ServeTriton(w, r)
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if errors.Is(err, tritonhttp.ErrBodyTooLarge) {
+			tritonhttp.Error(w, r, 413)
+			return
+		}
+		if err != nil {
+			tritonhttp.Error(w, r, 400)
+			return
+		}
+		body := fmt.Sprintf("%s|%d|%s", data, r.ContentLength, r.Trailer["X-Checksum"])
+		w.Header()["Content-Length"] = strconv.Itoa(len(body))
+		io.WriteString(w, body)
+	})
+	s := &tritonhttp.Server{
+		Addr:         "localhost:0",
+		VirtualHosts: tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs"),
+		Handler:      echo,
+		MaxBodyBytes: 32,
+	}
+	host, port, err := net.SplitHostPort(servetritonhttpd(t, s).String())
+	require.NoError(t, err, "Error parsing listen address")
+
+	tests := []struct {
+		name           string
+		headers        string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"Content-Length", "Content-Length: 5\r\n", "hello", 200, "hello|5|"},
+		{"Empty Content-Length", "Content-Length: 0\r\n", "", 200, "|0|"},
+		{"Chunked", "Transfer-Encoding: chunked\r\n", "5\r\nhello\r\n6;ext=1\r\n world\r\n0\r\n\r\n", 200, "hello world|-1|"},
+		{"Chunked With Trailer", "Transfer-Encoding: Chunked\r\n", "3\r\nabc\r\n0\r\nX-Checksum: 900150983cd2\r\n\r\n", 200, "abc|-1|900150983cd2"},
+		{"Body At Limit", "Content-Length: 32\r\n", strings.Repeat("x", 32), 200, strings.Repeat("x", 32) + "|32|"},
+		{"Content-Length Over Limit", "Content-Length: 33\r\n", strings.Repeat("x", 33), 413, ""},
+		{"Chunked Over Limit", "Transfer-Encoding: chunked\r\n", "21\r\n" + strings.Repeat("x", 33) + "\r\n0\r\n\r\n", 413, ""},
+		{"Content-Length And Transfer-Encoding", "Content-Length: 5\r\nTransfer-Encoding: chunked\r\n", "0\r\n\r\n", 400, ""},
+		{"Conflicting Content-Lengths", "Content-Length: 5\r\nContent-Length: 6\r\n", "hello!", 400, ""},
+		{"Invalid Content-Length", "Content-Length: -5\r\n", "", 400, ""},
+		{"Unsupported Transfer-Encoding", "Transfer-Encoding: gzip, chunked\r\n", "0\r\n\r\n", 501, ""},
+		{"Malformed Chunk Size", "Transfer-Encoding: chunked\r\n", "zz\r\nhello\r\n0\r\n\r\n", 400, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := "POST /echo HTTP/1.1\r\n" +
+				"Host: website1\r\n" +
+				tt.headers +
+				"Connection: close\r\n" +
+				"\r\n" +
+				tt.body
+
+			respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+			require.NoError(t, err, ErrSendingRequest)
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			require.NoError(t, err, ErrParsingResponse)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err, "Error reading response body")
+			resp.Body.Close()
+
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode, "Test %s: %s", tt.name, ErrStatusMsg)
+			if tt.expectedStatus == 200 {
+				assert.Equal(t, tt.expectedBody, string(body), "Test %s: Response body mismatch", tt.name)
+			}
+			if tt.expectedStatus == 413 {
+				assert.Equal(t, true, resp.Close, "Test %s: %s", tt.name, ErrConnectionHeaderMsg)
+			}
+		})
+	}
+
+	t.Run("Pipelined After Unread Body", func(t *testing.T) {
+		// FileHandler ignores the bodies; the server must skip them so the
+		// requests that follow are read from the right place
+		req := "POST /index.html HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"Content-Length: 11\r\n" +
+			"\r\n" +
+			"GET / HTTP/" +
+			"GET /index.html HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"4\r\nGET \r\n0\r\n\r\n" +
+			"GET /index.html HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"Connection: close\r\n" +
+			"\r\n"
+
+		respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+		require.NoError(t, err, ErrSendingRequest)
+		respreader := bufio.NewReader(bytes.NewReader(respbytes))
+
+		for i, expectedStatus := range []int{405, 200, 200} {
+			resp, err := http.ReadResponse(respreader, nil)
+			require.NoError(t, err, "Error parsing the response %d", i+1)
+			_, err = io.Copy(io.Discard, resp.Body)
+			require.NoError(t, err, "Error reading response body %d", i+1)
+			resp.Body.Close()
+			assert.Equal(t, expectedStatus, resp.StatusCode, "Response %d: %s", i+1, ErrStatusMsg)
+		}
+	})
+
+	t.Run("Largest Limit", func(t *testing.T) {
+		s := &tritonhttp.Server{
+			Addr:         "localhost:0",
+			VirtualHosts: tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs"),
+			Handler:      echo,
+			MaxBodyBytes: math.MaxInt64,
+		}
+		host, port, err := net.SplitHostPort(servetritonhttpd(t, s).String())
+		require.NoError(t, err, "Error parsing listen address")
+
+		// Both the handler reading its body and the server skipping an
+		// unread one must cope with a limit that has no room above it
+		req := "POST /echo HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"POST /index.html HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /index.html HTTP/1.1\r\n" +
+			"Host: website1\r\n" +
+			"Connection: close\r\n" +
+			"\r\n"
+
+		respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+		require.NoError(t, err, ErrSendingRequest)
+		respreader := bufio.NewReader(bytes.NewReader(respbytes))
+
+		for i, expectedStatus := range []int{200, 405, 200} {
+			resp, err := http.ReadResponse(respreader, nil)
+			require.NoError(t, err, "Error parsing the response %d", i+1)
+			_, err = io.Copy(io.Discard, resp.Body)
+			require.NoError(t, err, "Error reading response body %d", i+1)
+			resp.Body.Close()
+			assert.Equal(t, expectedStatus, resp.StatusCode, "Response %d: %s", i+1, ErrStatusMsg)
+		}
+	})
+}
+
+func TestAllFilesInHtdocs(t *testing.T) {
+	t.Parallel()
+	host, port := launchhttpd(t)
+
+	virtualHosts := tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")
+
+	for hostname, vhost := range virtualHosts {
+		docRoot := vhost.DocRoot
+		err := filepath.Walk(docRoot, func(path string, info os.FileInfo, err error) error {
+			require.NoError(t, err, "Error walking through docRoot")
+
+			if info.IsDir() {
+				return nil
+			}
+
+			testfile := strings.TrimPrefix(path, docRoot)
+			t.Run(testfile, func(t *testing.T) {
+				req := fmt.Sprintf("GET %s HTTP/1.1\r\n"+
+					"Host: "+hostname+"\r\n"+
+					"Connection: close\r\n"+
+					"User-Agent: gotest\r\n"+
+					"\r\n", testfile)
+
+				respbytes, _, err := tritonhttp.Fetch(host, port, []byte(req))
+				require.NoError(t, err, ErrSendingRequest)
+
+				resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+				require.NoError(t, err, ErrParsingResponse)
+
+				assert.Equal(t, HTTP1_1, resp.Proto, ErrProtocolMsg)
+				assert.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+
+				respcontenttype := resp.Header.Get("Content-Type")
+				assert.NotEmpty(t, respcontenttype, "Content-Type header is missing")
+
+				origmimetype := mime.TypeByExtension(filepath.Ext(path))
+				assert.Contains(t, origmimetype, respcontenttype, "Content-Type mismatch")
+
+				assert.Equal(t, info.Size(), resp.ContentLength, "Content-Length mismatch")
+
+				origcontents, err := os.ReadFile(path)
+				require.NoError(t, err, "Error reading input file")
+
+				respcontents, err := io.ReadAll(resp.Body)
+				require.NoError(t, err, "Error reading response body")
+				resp.Body.Close()
+
+				assert.True(t, bytes.Equal(origcontents, respcontents), "Response body does not match original file contents")
+			})
+
+			return nil
+		})
+		require.NoError(t, err, "Error walking the file tree")
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	t.Parallel()
+	virtualHosts := tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")
+	s := &tritonhttp.Server{
+		Addr:         "localhost:0",
+		VirtualHosts: virtualHosts,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.ListenAndServe()
+	}()
+
+	require.Eventually(t, func() bool { return s.ListenAddr() != nil }, time.Second, 10*time.Millisecond, "Server did not start listening")
+	addr := s.ListenAddr().String()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err, "Failed to dial the server")
+	defer conn.Close()
+
+	// Complete one request so the connection sits idle in keep-alive
+	_, err = fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: website1\r\n\r\n")
+	require.NoError(t, err, ErrSendingRequest)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err, ErrParsingResponse)
+	assert.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+	_, err = io.Copy(io.Discard, resp.Body)
+	require.NoError(t, err, "Error reading response body")
+	resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx), "Shutdown should finish before the deadline")
+	assert.ErrorIs(t, <-errc, tritonhttp.ErrServerClosed)
+
+	// The idle keep-alive connection is closed by the server
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF, "Expected idle connection to be closed")
+
+	// The listener no longer accepts connections
+	assert.Nil(t, s.ListenAddr(), "Expected no listen address after shutdown")
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err, "Expected listener to be closed")
+}
+
+func TestShutdownWaitsForActiveRequest(t *testing.T) {
+	t.Parallel()
+	virtualHosts := tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")
+	s := &tritonhttp.Server{
+		Addr:         "localhost:0",
+		VirtualHosts: virtualHosts,
+	}
+	addr := servetritonhttpd(t, s)
+
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err, "Failed to dial the server")
+	defer conn.Close()
+
+	// Start a request but do not finish sending its headers yet
+	_, err = fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: website1\r\n")
+	require.NoError(t, err, ErrSendingRequest)
+	time.Sleep(200 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	_, err = fmt.Fprint(conn, "\r\n")
+	require.NoError(t, err, ErrSendingRequest)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err, ErrParsingResponse)
+	assert.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+	assert.Equal(t, true, resp.Close, ErrConnectionHeaderMsg)
+	resp.Body.Close()
+
+	assert.NoError(t, <-done, "Shutdown should finish once the request is served")
+}
+
+func TestServeOnUnixSocket(t *testing.T) {
+	t.Parallel()
+
+	sock := filepath.Join(t.TempDir(), "tritonhttpd.sock")
+	ln, err := net.Listen("unix", sock)
+	require.NoError(t, err, "Error listening on unix socket")
+
+	virtualHosts := tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")
+	s := &tritonhttp.Server{VirtualHosts: virtualHosts}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Serve(ln)
+	}()
+
+	conn, err := net.Dial("unix", sock)
+	require.NoError(t, err, "Failed to dial the server")
+	defer conn.Close()
+
+	_, err = fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err, ErrSendingRequest)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err, ErrParsingResponse)
+	assert.Equal(t, 200, resp.StatusCode, ErrStatusMsg)
+	assert.Equal(t, int64(377), resp.ContentLength, "Content-Length mismatch")
+	resp.Body.Close()
+
+	assert.Equal(t, sock, s.ListenAddr().String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+	assert.ErrorIs(t, <-errc, tritonhttp.ErrServerClosed)
+}
+
+func TestListenAddrAfterListenerCloses(t *testing.T) {
+	t.Parallel()
+
+	first, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err, "Error listening")
+	second, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err, "Error listening")
+
+	s := &tritonhttp.Server{VirtualHosts: tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")}
+	errc := make(chan error, 2)
+	go func() {
+		errc <- s.Serve(first)
+	}()
+	require.Eventually(t, func() bool { return s.ListenAddr() != nil }, time.Second, 10*time.Millisecond, "Server did not start listening")
+	go func() {
+		errc <- s.Serve(second)
+	}()
+	require.Eventually(t, func() bool { return s.ListenAddr().String() == second.Addr().String() }, time.Second, 10*time.Millisecond, "Expected the latest listener")
+
+	// Once the latest listener is gone, the one still serving is reported
+	second.Close()
+	assert.ErrorIs(t, <-errc, net.ErrClosed)
+	assert.Equal(t, first.Addr().String(), s.ListenAddr().String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+	assert.ErrorIs(t, <-errc, tritonhttp.ErrServerClosed)
+	assert.Nil(t, s.ListenAddr(), "Expected no listen address after shutdown")
 }
@@ -0,0 +1,300 @@
+package tritonhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessLogEntry describes one request served by the server.
+type AccessLogEntry struct {
+	Time        time.Time     // when the server started reading the request
+	RemoteAddr  string        // e.g. "127.0.0.1:54321"
+	Method      string        // "" if the request could not be parsed
+	RequestURI  string        // the request target as sent
+	Protocol    string        // e.g. "HTTP/1.1"
+	Host        string        // the Host header
+	VirtualHost string        // the host name of the matching virtual host, or ""
+	Status      int           // the status code sent
+	BytesSent   int64         // the length of the body sent, without headers
+	Duration    time.Duration // how long the request took to serve
+	Referer     string
+	UserAgent   string
+}
+
+// An AccessLogger records the requests served by a Server. LogAccess is
+// called once per response, possibly from several goroutines at once.
+type AccessLogger interface {
+	LogAccess(entry AccessLogEntry)
+}
+
+// AccessLoggerFunc adapts an ordinary function to the AccessLogger interface.
+type AccessLoggerFunc func(entry AccessLogEntry)
+
+// LogAccess calls f(entry).
+func (f AccessLoggerFunc) LogAccess(entry AccessLogEntry) {
+	f(entry)
+}
+
+// AccessLogFormat selects how an AccessLog renders its entries.
+type AccessLogFormat string
+
+const (
+	// LogFormatCommon is the Common Log Format of the NCSA and Apache servers.
+	LogFormatCommon AccessLogFormat = "common"
+
+	// LogFormatCombined is LogFormatCommon followed by the Referer and
+	// User-Agent headers.
+	LogFormatCombined AccessLogFormat = "combined"
+
+	// LogFormatJSON writes each entry as a JSON object on its own line.
+	LogFormatJSON AccessLogFormat = "json"
+)
+
+func (f AccessLogFormat) valid() bool {
+	switch f {
+	case LogFormatCommon, LogFormatCombined, LogFormatJSON:
+		return true
+	}
+	return false
+}
+
+// clfTimeFormat is the timestamp layout of the Common Log Format.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLog is an AccessLogger writing lines to a file or to stdout.
+//
+// A file log can be reopened, e.g. on SIGHUP after logrotate has moved it
+// away, and can rotate itself once it reaches MaxSize bytes: the log is
+// renamed to path.1, path.1 to path.2 and so on, keeping MaxBackups files.
+type AccessLog struct {
+	// MaxSize is the size in bytes a log file may reach before it is
+	// rotated. Zero disables rotation. It must be set before the log is used.
+	MaxSize int64
+
+	// MaxBackups is the number of rotated files kept. Zero keeps one.
+	MaxBackups int
+
+	// Logger receives the errors of the log itself, such as a failed
+	// rotation. If nil, slog.Default() is used.
+	Logger *slog.Logger
+
+	path   string // "-" for stdout
+	format AccessLogFormat
+
+	mu     sync.Mutex
+	w      io.Writer
+	file   *os.File // nil when writing to stdout, or if the file failed to open
+	size   int64
+	closed bool
+}
+
+// logger returns the logger of l.
+func (l *AccessLog) logger() *slog.Logger {
+	if l.Logger != nil {
+		return l.Logger
+	}
+	return slog.Default()
+}
+
+// OpenAccessLog opens the access log at path, appending to it if it exists,
+// or uses stdout if path is "-".
+func OpenAccessLog(path string, format AccessLogFormat) (*AccessLog, error) {
+	if !format.valid() {
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+	l := &AccessLog{path: path, format: format, w: os.Stdout}
+	if path != "-" {
+		if err := l.open(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// open opens the log file and makes it the destination of new entries. On
+// failure, entries are dropped until open succeeds. The caller must hold
+// l.mu, except from OpenAccessLog.
+func (l *AccessLog) open() error {
+	l.file, l.w = nil, io.Discard
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fileinfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.w, l.size = file, file, fileinfo.Size()
+	return nil
+}
+
+// Reopen closes and reopens the log file, so that entries go to a new file
+// once the old one has been moved away. It also retries a file that failed
+// to open, e.g. during rotation. It does nothing for stdout or once the log
+// is closed.
+func (l *AccessLog) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.path == "-" || l.closed {
+		return nil
+	}
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			l.logger().Warn("Error closing access log", "path", l.path, "err", err)
+		}
+	}
+	return l.open()
+}
+
+// Close closes the log file. Entries logged afterwards are dropped.
+func (l *AccessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file, l.w = nil, io.Discard
+	return err
+}
+
+// rotate moves the current log file to path.1, shifting older backups, and
+// starts a new file. The caller must hold l.mu.
+func (l *AccessLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		l.logger().Warn("Error closing access log", "path", l.path, "err", err)
+	}
+	backups := l.MaxBackups
+	if backups <= 0 {
+		backups = 1
+	}
+	os.Remove(fmt.Sprintf("%v.%d", l.path, backups))
+	for i := backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%v.%d", l.path, i), fmt.Sprintf("%v.%d", l.path, i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		l.logger().Error("Error rotating access log", "path", l.path, "err", err)
+	}
+	return l.open()
+}
+
+func (l *AccessLog) LogAccess(entry AccessLogEntry) {
+	line, err := l.format.render(entry)
+	if err != nil {
+		l.logger().Error("Error encoding access log entry", "err", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case l.file == nil && l.path != "-" && !l.closed:
+		// The file failed to open before; the cause may be fixed by now
+		if err := l.open(); err != nil {
+			l.logger().Error("Error reopening access log", "path", l.path, "err", err)
+		}
+	case l.file != nil && l.MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.MaxSize:
+		if err := l.rotate(); err != nil {
+			l.logger().Error("Error reopening access log after rotation", "path", l.path, "err", err)
+		}
+	}
+	n, err := l.w.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		l.logger().Error("Error writing access log", "path", l.path, "err", err)
+	}
+}
+
+// render formats entry as one line of the log, including the newline.
+func (f AccessLogFormat) render(entry AccessLogEntry) ([]byte, error) {
+	if f == LogFormatJSON {
+		line, err := json.Marshal(struct {
+			Time        time.Time `json:"time"`
+			RemoteAddr  string    `json:"remoteAddr"`
+			Method      string    `json:"method"`
+			RequestURI  string    `json:"uri"`
+			Protocol    string    `json:"protocol"`
+			Host        string    `json:"host"`
+			VirtualHost string    `json:"vhost"`
+			Status      int       `json:"status"`
+			BytesSent   int64     `json:"bytes"`
+			DurationMs  float64   `json:"durationMs"`
+			Referer     string    `json:"referer"`
+			UserAgent   string    `json:"userAgent"`
+		}{
+			entry.Time, entry.RemoteAddr, entry.Method, entry.RequestURI, entry.Protocol,
+			entry.Host, entry.VirtualHost, entry.Status, entry.BytesSent,
+			float64(entry.Duration) / float64(time.Millisecond), entry.Referer, entry.UserAgent,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return append(line, '\n'), nil
+	}
+
+	var b bytes.Buffer
+	host, _, err := net.SplitHostPort(entry.RemoteAddr)
+	if err != nil {
+		host = entry.RemoteAddr
+	}
+	requestLine := "-"
+	if entry.Method != "" {
+		requestLine = entry.Method + " " + entry.RequestURI + " " + entry.Protocol
+	}
+	bytesSent := "-"
+	if entry.BytesSent > 0 {
+		bytesSent = strconv.FormatInt(entry.BytesSent, 10)
+	}
+	fmt.Fprintf(&b, "%v - - [%v] %v %v %v", clfField(host), entry.Time.Format(clfTimeFormat), clfQuote(requestLine), entry.Status, bytesSent)
+	if f == LogFormatCombined {
+		fmt.Fprintf(&b, " %v %v", clfQuote(dashIfEmpty(entry.Referer)), clfQuote(dashIfEmpty(entry.UserAgent)))
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// clfField returns s escaped for the log, or "-" if it is empty.
+func clfField(s string) string {
+	return dashIfEmpty(clfEscape(s))
+}
+
+// clfQuote returns s escaped for the log and in double quotes.
+func clfQuote(s string) string {
+	return `"` + clfEscape(s) + `"`
+}
+
+// clfEscape escapes quotes, backslashes and control characters, so that a
+// request cannot forge log lines.
+func clfEscape(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
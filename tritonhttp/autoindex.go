@@ -0,0 +1,167 @@
+package tritonhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AutoIndexConfig controls the listings generated for directories that
+// have no index file.
+type AutoIndexConfig struct {
+	// Enabled turns listings on. The zero value answers such directories
+	// with 404 Not Found.
+	Enabled bool `yaml:"enabled"`
+
+	// HideDotfiles leaves out entries whose name starts with a dot.
+	HideDotfiles bool `yaml:"hideDotfiles"`
+
+	// Hide lists glob patterns, as understood by path.Match, of entry names
+	// to leave out, e.g. "*.bak".
+	Hide []string `yaml:"hide,omitempty"`
+}
+
+func (c AutoIndexConfig) valid() error {
+	for _, pattern := range c.Hide {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid hide pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// hidden reports whether the entry with the given name is left out of
+// listings.
+func (c AutoIndexConfig) hidden(name string) bool {
+	if c.HideDotfiles && strings.HasPrefix(name, ".") {
+		return true
+	}
+	for _, pattern := range c.Hide {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// dirEntry is one entry of a directory listing.
+type dirEntry struct {
+	Name    string    `json:"name"`
+	IsDir   bool      `json:"isDir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// dirListing is a directory listing as rendered in JSON.
+type dirListing struct {
+	Path    string     `json:"path"`
+	Entries []dirEntry `json:"entries"`
+}
+
+var dirListingTemplate = template.Must(template.New("autoindex").Funcs(template.FuncMap{
+	"href": func(e dirEntry) string {
+		if e.IsDir {
+			return url.PathEscape(e.Name) + "/"
+		}
+		return url.PathEscape(e.Name)
+	},
+	"time": FormatTime,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Index of {{.Path}}</title>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Last modified</th><th>Size</th></tr>
+{{- if ne .Path "/"}}
+<tr><td><a href="../">../</a></td><td></td><td>-</td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr><td><a href="{{href .}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td><td>{{time .ModTime}}</td><td>{{if .IsDir}}-{{else}}{{.Size}}{{end}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// readDirListing lists the directory dirPath, served at urlPath, sorted by
+// name. Entries hidden by the configuration of vh, and links that vh does
+// not allow to follow, are left out.
+func readDirListing(vh VirtualHost, dirPath string, urlPath string) (dirListing, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return dirListing{}, err
+	}
+
+	listing := dirListing{Path: urlPath, Entries: []dirEntry{}}
+	for _, entry := range entries {
+		name := entry.Name()
+		if vh.AutoIndex.hidden(name) {
+			continue
+		}
+		entryPath, err := resolvePath(vh, path.Join(urlPath, name))
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(entryPath)
+		if err != nil {
+			continue
+		}
+		listing.Entries = append(listing.Entries, dirEntry{
+			Name:    name,
+			IsDir:   info.IsDir(),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UTC(),
+		})
+	}
+	sort.Slice(listing.Entries, func(i, j int) bool {
+		return listing.Entries[i].Name < listing.Entries[j].Name
+	})
+	return listing, nil
+}
+
+// serveDirListing writes the listing of the directory dirPath as HTML, or
+// as JSON if the client prefers application/json.
+func serveDirListing(w ResponseWriter, r *Request, dirPath string) {
+	listing, err := readDirListing(*r.VirtualHost, dirPath, r.URL)
+	if err != nil {
+		r.Logger().Error("Error listing directory", "path", dirPath, "err", err)
+		Error(w, r, StatusNotFound)
+		return
+	}
+
+	var body bytes.Buffer
+	contentType := negotiateContentType(r.Headers["Accept"], []string{"text/html", "application/json"})
+	if contentType == "application/json" {
+		err = json.NewEncoder(&body).Encode(listing)
+	} else {
+		contentType = "text/html; charset=utf-8"
+		err = dirListingTemplate.Execute(&body, listing)
+	}
+	if err != nil {
+		r.Logger().Error("Error rendering directory listing", "path", dirPath, "err", err)
+		Error(w, r, StatusInternalServerError)
+		return
+	}
+
+	header := w.Header()
+	header["Content-Type"] = contentType
+	header["Content-Length"] = fmt.Sprintf("%v", body.Len())
+	header["Vary"] = "Accept"
+	w.WriteHeader(StatusOK)
+	if r.Method != MethodHead {
+		if _, err := body.WriteTo(w); err != nil {
+			r.Logger().Debug("Error writing directory listing", "path", dirPath, "err", err)
+		}
+	}
+}
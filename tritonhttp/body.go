@@ -0,0 +1,234 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrBodyTooLarge is returned when reading a request body that exceeds the
+// server's MaxBodyBytes.
+var ErrBodyTooLarge = errors.New("tritonhttp: request body too large")
+
+// NoBody is the Body of a request without a body. It is always at EOF.
+var NoBody = noBody{}
+
+type noBody struct{}
+
+func (noBody) Read([]byte) (int, error) { return 0, io.EOF }
+
+// maxDrainBytes is how much of a body left unread by the handler the server
+// discards to reuse the connection; larger leftovers close the connection.
+const maxDrainBytes = 256 << 10
+
+// maxChunkSizeLen bounds the hex digits of a chunk size, i.e. 2^64-1 bytes.
+const maxChunkSizeLen = 16
+
+// setBody sets up r.Body according to the Content-Length and
+// Transfer-Encoding headers. A request with both is rejected, since the two
+// could be used to smuggle a second request past an intermediary.
+func (r *Request) setBody(conn net.Conn, br *bufio.Reader, logger *slog.Logger, timeout time.Duration) error {
+	te, hasTE := r.Headers["Transfer-Encoding"]
+	cl, hasCL := r.Headers["Content-Length"]
+	reader := &deadlineReader{conn: conn, r: br, timeout: timeout}
+
+	switch {
+	case hasTE && hasCL:
+		return fmt.Errorf("both Transfer-Encoding and Content-Length present")
+
+	case hasTE:
+		if !strings.EqualFold(strings.TrimSpace(te), "chunked") {
+			return &statusError{StatusNotImplemented, fmt.Errorf("unsupported Transfer-Encoding: %q", te)}
+		}
+		r.ContentLength = -1
+		r.Trailer = make(map[string]string)
+		r.Body = &chunkedReader{conn: conn, br: br, logger: logger, timeout: timeout, data: reader, trailer: r.Trailer}
+
+	case hasCL:
+		n, err := parseContentLength(cl)
+		if err != nil {
+			return err
+		}
+		r.ContentLength = n
+		r.Body = io.LimitReader(reader, n)
+
+	default:
+		r.Body = NoBody
+	}
+	return nil
+}
+
+// parseContentLength parses a Content-Length value, which must consist of
+// decimal digits only.
+func parseContentLength(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.TrimLeft(value, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid Content-Length: %q", value)
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Content-Length: %q", value)
+	}
+	return n, nil
+}
+
+// deadlineReader refreshes the read deadline of conn before every read, so
+// a body is subject to the same inactivity timeout as the request headers.
+type deadlineReader struct {
+	conn    net.Conn
+	r       io.Reader
+	timeout time.Duration
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if err := d.conn.SetReadDeadline(time.Now().Add(d.timeout)); err != nil {
+		return 0, err
+	}
+	return d.r.Read(p)
+}
+
+// chunkedReader decodes a body sent with "Transfer-Encoding: chunked". The
+// trailer fields following the last chunk are stored in trailer once the
+// body has been read to EOF.
+type chunkedReader struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	logger  *slog.Logger
+	timeout time.Duration
+	data    io.Reader
+	trailer map[string]string
+
+	remaining int64 // bytes left in the current chunk
+	started   bool  // whether a chunk has been read, and needs its CRLF consumed
+	err       error
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.remaining == 0 {
+		if c.err = c.nextChunk(); c.err != nil {
+			return 0, c.err
+		}
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.data.Read(p)
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	c.err = err
+	return n, err
+}
+
+// nextChunk reads the size line of the next chunk. After the last chunk it
+// reads the trailer and returns io.EOF.
+func (c *chunkedReader) nextChunk() error {
+	if c.started {
+		line, err := readLine(c.conn, c.br, c.logger, c.timeout, time.Time{})
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if line != "" {
+			return fmt.Errorf("malformed chunk: missing CRLF after chunk data")
+		}
+	}
+	c.started = true
+
+	line, err := readLine(c.conn, c.br, c.logger, c.timeout, time.Time{})
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+
+	// Chunk extensions after ";" are ignored
+	sizeText, _, _ := strings.Cut(line, ";")
+	sizeText = strings.TrimSpace(sizeText)
+	if sizeText == "" || len(sizeText) > maxChunkSizeLen {
+		return fmt.Errorf("malformed chunk size: %q", line)
+	}
+	size, err := strconv.ParseUint(sizeText, 16, 64)
+	if err != nil || size > 1<<62 {
+		return fmt.Errorf("malformed chunk size: %q", line)
+	}
+	if size > 0 {
+		c.remaining = int64(size)
+		return nil
+	}
+
+	return c.readTrailer()
+}
+
+// readTrailer reads the trailer fields after the last chunk up to the blank
+// line that ends the body, then returns io.EOF.
+func (c *chunkedReader) readTrailer() error {
+	for {
+		line, err := readLine(c.conn, c.br, c.logger, c.timeout, time.Time{})
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if line == "" {
+			return io.EOF
+		}
+
+		key, value, err := parseHTTPHeader(line)
+		if err != nil {
+			return err
+		}
+		if !validHTTPHeader(key, value) {
+			return fmt.Errorf("invalid trailer field: %q", line)
+		}
+
+		// Fields that frame or route the message are not allowed in a trailer
+		switch key {
+		case "Content-Length", "Transfer-Encoding", "Host", "Trailer":
+			continue
+		}
+		c.trailer[key] = value
+	}
+}
+
+// unexpectedEOF turns io.EOF in the middle of a body into io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// maxBytesReader limits a request body to n bytes, returning
+// ErrBodyTooLarge when the client sends more.
+type maxBytesReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if m.exceeded {
+		return 0, ErrBodyTooLarge
+	}
+	// Read one byte more than allowed to tell a body of exactly n bytes
+	// from a longer one
+	if int64(len(p)) > m.n {
+		p = p[:m.n+1]
+	}
+	n, err := m.r.Read(p)
+	if int64(n) > m.n {
+		m.exceeded = true
+		n = int(m.n)
+		m.n = 0
+		return n, ErrBodyTooLarge
+	}
+	m.n -= int64(n)
+	return n, err
+}
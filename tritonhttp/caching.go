@@ -0,0 +1,82 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CachingConfig controls the Cache-Control header of the static files of a
+// virtual host. The zero value sends no Cache-Control header, leaving
+// clients to their heuristics.
+type CachingConfig struct {
+	// MaxAge is how long clients may use a file without revalidating it.
+	MaxAge time.Duration `yaml:"maxAge"`
+
+	// Types overrides MaxAge by media type, e.g. "text/html": 0s, or by
+	// top-level type, e.g. "image/*": 24h. Zero means clients must always
+	// revalidate ("no-cache").
+	Types map[string]time.Duration `yaml:"types,omitempty"`
+
+	// Immutable tells clients not to revalidate a file before its max-age
+	// runs out, e.g. for file names that change with their content.
+	Immutable bool `yaml:"immutable"`
+}
+
+func (c CachingConfig) valid() error {
+	if c.MaxAge < 0 {
+		return fmt.Errorf("negative maxAge %v", c.MaxAge)
+	}
+	for mediaType, maxAge := range c.Types {
+		if _, _, err := mime.ParseMediaType(mediaType); err != nil || !strings.Contains(mediaType, "/") {
+			return fmt.Errorf("invalid media type %q", mediaType)
+		}
+		if maxAge < 0 {
+			return fmt.Errorf("negative max-age %v for %v", maxAge, mediaType)
+		}
+	}
+	return nil
+}
+
+// cacheControl returns the Cache-Control header of a file with the given
+// Content-Type, or "" if none should be sent.
+func (c CachingConfig) cacheControl(contentType string) string {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	maxAge, ok := c.lookupType(mediaType)
+	if !ok {
+		if c.MaxAge == 0 {
+			return ""
+		}
+		maxAge = c.MaxAge
+	}
+
+	if maxAge == 0 {
+		return "no-cache"
+	}
+	value := "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+	if c.Immutable {
+		value += ", immutable"
+	}
+	return value
+}
+
+// lookupType finds the max-age configured for mediaType, either exactly or
+// for its top-level type.
+func (c CachingConfig) lookupType(mediaType string) (time.Duration, bool) {
+	topLevel, _, _ := strings.Cut(mediaType, "/")
+	var wildcard time.Duration
+	found := false
+	for pattern, maxAge := range c.Types {
+		pattern = strings.ToLower(pattern)
+		if pattern == mediaType {
+			return maxAge, true
+		}
+		if pattern == topLevel+"/*" {
+			wildcard, found = maxAge, true
+		}
+	}
+	return wildcard, found
+}
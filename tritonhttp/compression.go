@@ -0,0 +1,168 @@
+package tritonhttp
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// CompressionConfig controls compression of the static files of a virtual
+// host, either on the fly or from precompressed sidecar files. Files of type
+// text/* are always eligible for compression on the fly once enabled.
+type CompressionConfig struct {
+	// Enabled turns compression on. The zero value leaves it off.
+	Enabled bool `yaml:"enabled"`
+
+	// Types lists further media types to compress, e.g. "application/json".
+	// An entry like "image/*" matches every subtype.
+	Types []string `yaml:"types,omitempty"`
+
+	// MinSize is the smallest file size in bytes worth compressing. Zero
+	// means defaultCompressMinSize.
+	MinSize int64 `yaml:"minSize"`
+
+	// Level is the compression level from 1 (fastest) to 9 (smallest).
+	// Zero means the default level of compress/flate.
+	Level int `yaml:"level"`
+
+	// Precompressed serves a sidecar file such as index.html.br,
+	// index.html.zst or index.html.gz in place of index.html when the
+	// client accepts its encoding. It works whether or not Enabled is set.
+	Precompressed bool `yaml:"precompressed"`
+}
+
+// defaultCompressMinSize is the MinSize used when none is configured.
+// Smaller files gain little and may even grow.
+const defaultCompressMinSize = 1024
+
+// compressEncodings are the content codings applied on the fly, in order
+// of preference when the client accepts several equally.
+var compressEncodings = []string{"gzip", "deflate"}
+
+// precompressedEncodings are the content codings of sidecar files, in
+// order of preference, and precompressedExts their file name extensions.
+var (
+	precompressedEncodings = []string{"br", "zstd", "gzip"}
+	precompressedExts      = map[string]string{"br": ".br", "zstd": ".zst", "gzip": ".gz"}
+)
+
+func (c CompressionConfig) valid() error {
+	if c.Level != 0 && (c.Level < flate.BestSpeed || c.Level > flate.BestCompression) {
+		return fmt.Errorf("compression level %v is not between %v and %v", c.Level, flate.BestSpeed, flate.BestCompression)
+	}
+	if c.MinSize < 0 {
+		return fmt.Errorf("negative compression minSize %v", c.MinSize)
+	}
+	return nil
+}
+
+// compressible reports whether a file of the given Content-Type and size
+// should be compressed.
+func (c CompressionConfig) compressible(contentType string, size int64) bool {
+	if !c.Enabled {
+		return false
+	}
+	minSize := c.MinSize
+	if minSize == 0 {
+		minSize = defaultCompressMinSize
+	}
+	if size < minSize {
+		return false
+	}
+
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	for _, t := range c.Types {
+		t = strings.ToLower(t)
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// level returns the level to pass to compress/gzip and compress/zlib.
+func (c CompressionConfig) level() int {
+	if c.Level == 0 {
+		return flate.DefaultCompression
+	}
+	return c.Level
+}
+
+// negotiateEncoding picks the content coding to use from offers given the
+// value of an Accept-Encoding header, following RFC 9110 section 12.5.3.
+// The offer with the highest q-value wins, ties going to the earlier
+// offer. It returns "" if the response should not be encoded, which is
+// also the case when the client prefers identity.
+func negotiateEncoding(acceptEncoding string, offers []string) string {
+	qvalues := make(map[string]float64)
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(entry, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.EqualFold(strings.TrimSpace(name), "q") {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				continue
+			}
+			q = parsed
+		}
+		qvalues[coding] = q
+	}
+
+	qvalue := func(coding string) (float64, bool) {
+		if q, ok := qvalues[coding]; ok {
+			return q, true
+		}
+		q, ok := qvalues["*"]
+		return q, ok
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q, ok := qvalue(offer); ok && q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	// Identity is acceptable unless excluded, but only wins when the
+	// client asks for it with a higher q-value
+	if identityQ, ok := qvalue("identity"); ok && identityQ > bestQ {
+		return ""
+	}
+	return best
+}
+
+// compressedETag derives the entity tag of an encoded representation from
+// that of the file. It is weak because the encoded bytes depend on the
+// compression level.
+func compressedETag(etag string, encoding string) string {
+	return `W/` + strings.TrimSuffix(strings.TrimPrefix(etag, "W/"), `"`) + "-" + encoding + `"`
+}
+
+// newCompressor returns a writer that compresses into w with the given
+// content coding.
+func newCompressor(w io.Writer, encoding string, level int) (io.WriteCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewWriterLevel(w, level)
+	case "deflate":
+		// The "deflate" coding is the zlib format of RFC 1950
+		return zlib.NewWriterLevel(w, level)
+	default:
+		return nil, fmt.Errorf("unsupported content coding %q", encoding)
+	}
+}
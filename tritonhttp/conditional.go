@@ -0,0 +1,78 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// fileETag returns a strong entity tag for the file derived from its
+// modification time and size, so it changes whenever the file is rewritten.
+func fileETag(fileinfo os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fileinfo.ModTime().UnixNano(), fileinfo.Size())
+}
+
+// isWeakETag reports whether etag carries the W/ weakness indicator.
+func isWeakETag(etag string) bool {
+	return strings.HasPrefix(etag, "W/")
+}
+
+// etagMatch compares two entity tags. The strong comparison requires both
+// tags to be strong and identical; the weak comparison ignores the W/ prefix.
+func etagMatch(a, b string, strong bool) bool {
+	if strong {
+		return !isWeakETag(a) && !isWeakETag(b) && a == b
+	}
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// etagListMatch reports whether etag matches any entry of an If-Match or
+// If-None-Match header value. The value "*" matches any current representation.
+func etagListMatch(header string, etag string, strong bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if etagMatch(strings.TrimSpace(candidate), etag, strong) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions evaluates the conditional request headers of req
+// against the selected file in the order given by RFC 9110 section 13.2.2.
+// It returns 304 or 412 if the request should be answered without the
+// file, or 0 if the file should be served normally.
+func checkPreconditions(req *Request, etag string, modTime time.Time) int {
+	// Last-Modified has one second resolution
+	modTime = modTime.Truncate(time.Second)
+
+	if ifMatch, ok := req.Headers["If-Match"]; ok {
+		if !etagListMatch(ifMatch, etag, true) {
+			return StatusPreconditionFailed
+		}
+	} else if ifUnmodifiedSince, ok := req.Headers["If-Unmodified-Since"]; ok {
+		if t, err := ParseTime(ifUnmodifiedSince); err == nil && modTime.After(t) {
+			return StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch, ok := req.Headers["If-None-Match"]; ok {
+		if etagListMatch(ifNoneMatch, etag, false) {
+			if req.Method == MethodGet || req.Method == MethodHead {
+				return StatusNotModified
+			}
+			return StatusPreconditionFailed
+		}
+	} else if ifModifiedSince, ok := req.Headers["If-Modified-Since"]; ok {
+		if req.Method == MethodGet || req.Method == MethodHead {
+			if t, err := ParseTime(ifModifiedSince); err == nil && !modTime.After(t) {
+				return StatusNotModified
+			}
+		}
+	}
+
+	return 0
+}
@@ -7,3 +7,11 @@ const (
 	SEND_TIMEOUT    time.Duration = 5 * time.Second
 	RECV_TIMEOUT    time.Duration = 5*time.Second + 100*time.Millisecond
 )
+
+// READ_TIMEOUT is how long the server waits for the next byte of a request.
+const READ_TIMEOUT time.Duration = 5 * time.Second
+
+// READ_HEADER_TIMEOUT is how long the server waits for the request line and
+// headers of a request as a whole, so that a client sending a byte now and
+// then cannot hold a connection forever.
+const READ_HEADER_TIMEOUT time.Duration = 20 * time.Second
@@ -0,0 +1,122 @@
+package tritonhttp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SymlinkPolicy controls how symbolic links under a docroot are treated.
+// Whatever the policy, a link is never followed to a file outside the docroot.
+type SymlinkPolicy string
+
+const (
+	// SymlinksFollow follows symbolic links.
+	SymlinksFollow SymlinkPolicy = "follow"
+
+	// SymlinksIfOwnerMatch follows a symbolic link only if it is owned by
+	// the same user as the file or directory it points to.
+	SymlinksIfOwnerMatch SymlinkPolicy = "owner"
+
+	// SymlinksDeny refuses to serve any path that goes through a symbolic link.
+	SymlinksDeny SymlinkPolicy = "deny"
+)
+
+func (p SymlinkPolicy) valid() bool {
+	switch p {
+	case "", SymlinksFollow, SymlinksIfOwnerMatch, SymlinksDeny:
+		return true
+	}
+	return false
+}
+
+var (
+	errOutsideDocRoot = errors.New("path is outside the document root")
+	errSymlinkDenied  = errors.New("symbolic link not allowed")
+)
+
+// withinDir reports whether path is dir itself or lies inside it. Both
+// must be clean; unlike a string prefix check, "/htdocs10" is not within
+// "/htdocs1".
+func withinDir(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolvePath maps the URL path of a request to a file under the docroot
+// of vh. It returns an error if the path escapes the docroot, either
+// lexically or through a symbolic link, or if a symbolic link on the way is
+// not allowed by vh.Symlinks.
+func resolvePath(vh VirtualHost, urlPath string) (string, error) {
+	docRoot := filepath.Clean(vh.DocRoot)
+	path := filepath.Clean(docRoot + filepath.FromSlash(urlPath))
+	if !withinDir(docRoot, path) {
+		return "", errOutsideDocRoot
+	}
+
+	// Check every component below the docroot for symbolic links
+	rel, err := filepath.Rel(docRoot, path)
+	if err != nil {
+		return "", err
+	}
+	current := docRoot
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		if name == "." {
+			continue
+		}
+		current = filepath.Join(current, name)
+		if err := checkSymlink(vh.Symlinks, current); err != nil {
+			return "", err
+		}
+	}
+
+	// Wherever the links lead, the file itself must be inside the docroot
+	realDocRoot, err := filepath.EvalSymlinks(docRoot)
+	if err != nil {
+		return "", err
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	if !withinDir(realDocRoot, realPath) {
+		return "", errOutsideDocRoot
+	}
+
+	return path, nil
+}
+
+// checkSymlink returns an error if path is a symbolic link that policy does
+// not allow to follow.
+func checkSymlink(policy SymlinkPolicy, path string) error {
+	linkInfo, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if linkInfo.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+
+	switch policy {
+	case "", SymlinksFollow:
+		return nil
+	case SymlinksIfOwnerMatch:
+		targetInfo, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		linkOwner, ok1 := fileOwner(linkInfo)
+		targetOwner, ok2 := fileOwner(targetInfo)
+		if !ok1 || !ok2 || linkOwner != targetOwner {
+			return fmt.Errorf("%w: %s is not owned by the owner of its target", errSymlinkDenied, path)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", errSymlinkDenied, path)
+	}
+}
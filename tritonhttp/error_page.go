@@ -0,0 +1,87 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+// maxErrorPageBytes is the largest error document that is served; error
+// pages are read into memory to set their Content-Length.
+const maxErrorPageBytes = 1 << 20
+
+// validErrorPages checks the ErrorPages of a virtual host: each key must be
+// a 4xx or 5xx status code and each value a URL path.
+func validErrorPages(pages map[int]string) error {
+	for code, page := range pages {
+		if code < 400 || code > 599 {
+			return fmt.Errorf("error page for status %v, which is not an error", code)
+		}
+		if !strings.HasPrefix(page, "/") {
+			return fmt.Errorf("error page %q for status %v does not start with /", page, code)
+		}
+	}
+	return nil
+}
+
+// errorBody returns the body of an error response to r with the given
+// status code and its Content-Type: the error page configured for the
+// virtual host if there is one, or else a built-in page. r may be nil.
+func errorBody(r *Request, statusCode int) (string, []byte) {
+	if r != nil && r.VirtualHost != nil {
+		if page, ok := r.VirtualHost.ErrorPages[statusCode]; ok {
+			contentType, body, err := readErrorPage(*r.VirtualHost, page)
+			if err == nil {
+				return contentType, body
+			}
+			r.Logger().Warn("Error reading error page", "page", page, "status", statusCode, "err", err)
+		}
+	}
+
+	accept := ""
+	if r != nil {
+		accept = r.Headers["Accept"]
+	}
+	return builtinErrorBody(accept, statusCode)
+}
+
+// readErrorPage reads the error document at urlPath under the docroot of vh.
+func readErrorPage(vh VirtualHost, urlPath string) (string, []byte, error) {
+	file, fileinfo, filePath, err := openFile(vh, urlPath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	if !fileinfo.Mode().IsRegular() {
+		return "", nil, fmt.Errorf("not a regular file")
+	}
+	if fileinfo.Size() > maxErrorPageBytes {
+		return "", nil, fmt.Errorf("larger than %v bytes", maxErrorPageBytes)
+	}
+	body, err := io.ReadAll(io.LimitReader(file, maxErrorPageBytes))
+	if err != nil {
+		return "", nil, err
+	}
+	return vh.MIME.contentType(filePath, file), body, nil
+}
+
+// builtinErrorBody renders a minimal page for the status code, in HTML or
+// in plain text depending on the Accept header.
+func builtinErrorBody(accept string, statusCode int) (string, []byte) {
+	status := fmt.Sprintf("%v %v", statusCode, StatusCodeText[statusCode])
+	if negotiateContentType(accept, []string{"text/html", "text/plain"}) == "text/plain" {
+		return "text/plain; charset=utf-8", []byte(status + "\n")
+	}
+
+	status = html.EscapeString(status)
+	body := "<!DOCTYPE html>\n" +
+		"<html>\n" +
+		"<head><title>" + status + "</title></head>\n" +
+		"<body>\n" +
+		"<h1>" + status + "</h1>\n" +
+		"</body>\n" +
+		"</html>\n"
+	return "text/html; charset=utf-8", []byte(body)
+}
@@ -0,0 +1,292 @@
+package tritonhttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// FileHandler serves static files from the docroot of the virtual host
+// matching the request. It is the default handler of a Server.
+type FileHandler struct{}
+
+func (FileHandler) ServeTriton(w ResponseWriter, r *Request) {
+	if r.VirtualHost == nil {
+		r.Logger().Debug("No virtual host for Host header", "host", r.Host)
+		Error(w, r, StatusNotFound)
+		return
+	}
+	if r.Method != MethodGet && r.Method != MethodHead {
+		Error(w, r, StatusMethodNotAllowed)
+		return
+	}
+
+	file, fileinfo, filePath, err := openFile(*r.VirtualHost, r.URL)
+	if err != nil {
+		r.Logger().Debug("Cannot serve from document root", "url", r.URL, "docroot", r.VirtualHost.DocRoot, "err", err)
+		Error(w, r, StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	if !fileinfo.IsDir() {
+		// A trailing slash names a directory, which this is not
+		if strings.HasSuffix(r.URL, "/") {
+			r.Logger().Debug("Not serving file as a directory", "url", r.URL)
+			Error(w, r, StatusNotFound)
+			return
+		}
+		serveStatic(w, r, r.URL, file, fileinfo, filePath)
+		return
+	}
+
+	// Relative links in the index only work if the URL ends in a slash
+	if !strings.HasSuffix(r.URL, "/") {
+		// A leading "//" would make the location point to another host
+		location := "/" + strings.TrimLeft(r.RawPath, "/") + "/"
+		if r.RawQuery != "" {
+			location += "?" + r.RawQuery
+		}
+		Redirect(w, r, location, StatusMovedPermanently)
+		return
+	}
+
+	for _, name := range r.VirtualHost.indexFiles() {
+		indexURL := r.URL + name
+		index, indexinfo, indexPath, err := openFile(*r.VirtualHost, indexURL)
+		if err != nil {
+			continue
+		}
+		defer index.Close()
+		if indexinfo.Mode().IsRegular() {
+			serveStatic(w, r, indexURL, index, indexinfo, indexPath)
+			return
+		}
+	}
+
+	if !r.VirtualHost.AutoIndex.Enabled {
+		r.Logger().Debug("No index file and listings are disabled", "url", r.URL)
+		Error(w, r, StatusNotFound)
+		return
+	}
+	serveDirListing(w, r, filePath)
+}
+
+// openFile opens the file or directory at urlPath under the docroot of vh.
+func openFile(vh VirtualHost, urlPath string) (*os.File, os.FileInfo, string, error) {
+	filePath, err := resolvePath(vh, urlPath)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	fileinfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, "", err
+	}
+	return file, fileinfo, filePath, nil
+}
+
+// serveStatic serves the file found at urlPath, or one of its precompressed
+// sidecars.
+func serveStatic(w ResponseWriter, r *Request, urlPath string, file *os.File, fileinfo os.FileInfo, filePath string) {
+	contentType := r.VirtualHost.MIME.contentType(filePath, file)
+	if r.VirtualHost.Compression.Precompressed && fileinfo.Mode().IsRegular() {
+		if sidecar, sidecarinfo, encoding := openPrecompressed(w, r, urlPath, fileinfo); sidecar != nil {
+			defer sidecar.Close()
+			serveFile(w, r, sidecar, sidecarinfo, contentType, encoding)
+			return
+		}
+	}
+
+	serveFile(w, r, file, fileinfo, contentType, "")
+}
+
+// openPrecompressed opens the sidecar of the file at urlPath, e.g.
+// index.html.gz next to index.html, whose encoding best matches the
+// Accept-Encoding header of r. Sidecars older than the file are stale and
+// ignored. It returns a nil file if the file itself should be served.
+func openPrecompressed(w ResponseWriter, r *Request, urlPath string, fileinfo os.FileInfo) (*os.File, os.FileInfo, string) {
+	var offers []string
+	paths := make(map[string]string)
+	for _, encoding := range precompressedEncodings {
+		path, err := resolvePath(*r.VirtualHost, urlPath+precompressedExts[encoding])
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() || info.ModTime().Before(fileinfo.ModTime()) {
+			continue
+		}
+		offers = append(offers, encoding)
+		paths[encoding] = path
+	}
+	if len(offers) == 0 {
+		return nil, nil, ""
+	}
+
+	// The file has encoded variants, even if this response is not one.
+	// Range requests are always answered from the file itself.
+	w.Header()["Vary"] = "Accept-Encoding"
+	if _, ok := r.Headers["Range"]; ok {
+		return nil, nil, ""
+	}
+	encoding := negotiateEncoding(r.Headers["Accept-Encoding"], offers)
+	if encoding == "" {
+		return nil, nil, ""
+	}
+
+	file, err := os.Open(paths[encoding])
+	if err != nil {
+		r.Logger().Error("Error opening precompressed file", "err", err)
+		return nil, nil, ""
+	}
+	info, err := file.Stat()
+	if err != nil {
+		r.Logger().Error("Error getting precompressed file info", "err", err)
+		file.Close()
+		return nil, nil, ""
+	}
+	return file, info, encoding
+}
+
+// serveFile writes file to w with the given Content-Type, honoring the
+// conditional and Range headers of r. A HEAD request gets the same headers
+// as the equivalent GET request. If encoding is set, file is already
+// encoded with that content coding; otherwise it may be compressed on the
+// fly.
+func serveFile(w ResponseWriter, r *Request, file *os.File, fileinfo os.FileInfo, contentType string, encoding string) {
+	header := w.Header()
+	size := fileinfo.Size()
+	etag := fileETag(fileinfo)
+
+	// Pick a content coding for compressible files. Range requests are
+	// always answered from the uncompressed file.
+	var compression CompressionConfig
+	if r.VirtualHost != nil {
+		compression = r.VirtualHost.Compression
+	}
+	compress := ""
+	if encoding == "" && compression.compressible(contentType, size) {
+		header["Vary"] = "Accept-Encoding"
+		if _, ok := r.Headers["Range"]; !ok {
+			compress = negotiateEncoding(r.Headers["Accept-Encoding"], compressEncodings)
+		}
+	}
+	if compress != "" {
+		etag = compressedETag(etag, compress)
+	}
+
+	header["ETag"] = etag
+	header["Last-Modified"] = FormatTime(fileinfo.ModTime())
+	if r.VirtualHost != nil {
+		if cacheControl := r.VirtualHost.Caching.cacheControl(contentType); cacheControl != "" {
+			header["Cache-Control"] = cacheControl
+		}
+	}
+
+	// Answer conditional requests without the file
+	if code := checkPreconditions(r, etag, fileinfo.ModTime()); code != 0 {
+		if code == StatusNotModified {
+			w.WriteHeader(code)
+		} else {
+			Error(w, r, code)
+		}
+		return
+	}
+
+	header["Accept-Ranges"] = "bytes"
+	header["Content-Type"] = contentType
+	if encoding != "" {
+		header["Content-Encoding"] = encoding
+	}
+
+	// The compressed length is not known up front, so the body is chunked
+	if compress != "" {
+		header["Content-Encoding"] = compress
+		w.WriteHeader(StatusOK)
+		if r.Method != MethodHead {
+			if err := writeCompressed(w, file, compress, compression.level()); err != nil {
+				// The length is not known, so only a cut off body tells
+				// the client that the file is incomplete
+				r.Logger().Debug("Error writing file", "path", file.Name(), "err", err)
+				panic(ErrAbortHandler)
+			}
+		}
+		return
+	}
+
+	var ranges []byteRange
+	if rangeHeader, ok := r.Headers["Range"]; ok && ifRangeMatch(r, etag, header["Last-Modified"]) {
+		var err error
+		ranges, err = parseRange(rangeHeader, size)
+		if errors.Is(err, errUnsatisfiableRange) {
+			delete(header, "Content-Type")
+			header["Content-Range"] = fmt.Sprintf("bytes */%d", size)
+			Error(w, r, StatusRangeNotSatisfiable)
+			return
+		}
+		if err != nil {
+			r.Logger().Debug("Ignoring Range header", "err", err)
+		}
+
+		// Overlapping ranges asking for more than the whole file get the whole file
+		var total int64
+		for _, br := range ranges {
+			total += br.length()
+		}
+		if total > size {
+			ranges = nil
+		}
+	}
+
+	var err error
+	switch {
+	case len(ranges) == 0:
+		header["Content-Length"] = fmt.Sprintf("%v", size)
+		w.WriteHeader(StatusOK)
+		if r.Method != MethodHead {
+			_, err = io.Copy(w, file)
+		}
+
+	case len(ranges) == 1:
+		header["Content-Range"] = ranges[0].contentRange(size)
+		header["Content-Length"] = fmt.Sprintf("%v", ranges[0].length())
+		w.WriteHeader(StatusPartialContent)
+		if r.Method != MethodHead {
+			err = writeRange(w, file, ranges[0])
+		}
+
+	default:
+		boundary := newBoundary()
+		header["Content-Type"] = "multipart/byteranges; boundary=" + boundary
+		header["Content-Length"] = fmt.Sprintf("%v", multipartLength(boundary, contentType, ranges, size))
+		w.WriteHeader(StatusPartialContent)
+		if r.Method != MethodHead {
+			err = writeMultipartRanges(w, file, boundary, contentType, ranges, size)
+		}
+	}
+	if err != nil {
+		r.Logger().Debug("Error writing file", "path", file.Name(), "err", err)
+	}
+}
+
+// writeCompressed copies file to w compressed with the given content coding.
+func writeCompressed(w io.Writer, file *os.File, encoding string, level int) error {
+	cw, err := newCompressor(w, encoding, level)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(cw, file); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
@@ -0,0 +1,100 @@
+package tritonhttp
+
+import (
+	"strconv"
+)
+
+// A Handler responds to a request by writing a response to w. The server
+// reads the request and takes care of framing and keep-alive; the handler
+// only decides the status, headers and body.
+type Handler interface {
+	ServeTriton(w ResponseWriter, r *Request)
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface.
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+// ServeTriton calls f(w, r).
+func (f HandlerFunc) ServeTriton(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// Middleware wraps a Handler to add behavior before or after it, such as
+// authentication, redirects or logging.
+type Middleware func(next Handler) Handler
+
+// Chain wraps h with the given middlewares. The first middleware is the
+// outermost one, so it sees the request first and the response last.
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Error replies to the request with the given status code and an error
+// page as the body: the one configured for the virtual host of r, or else a
+// built-in HTML or plain text page depending on the Accept header. It does
+// not otherwise end the request; the caller should return afterwards.
+func Error(w ResponseWriter, r *Request, statusCode int) {
+	header := w.Header()
+	// A handler answering other methods knows best what it allows
+	if _, ok := header["Allow"]; !ok && statusCode == StatusMethodNotAllowed {
+		header["Allow"] = allowedMethods
+	}
+	if !bodyAllowed(statusCode) {
+		header["Content-Length"] = "0"
+		w.WriteHeader(statusCode)
+		return
+	}
+
+	contentType, body := errorBody(r, statusCode)
+	delete(header, "Content-Encoding")
+	header["Content-Type"] = contentType
+	header["Content-Length"] = strconv.Itoa(len(body))
+	w.WriteHeader(statusCode)
+	if _, err := w.Write(body); err != nil {
+		r.Logger().Debug("Error writing error response", "status", statusCode, "err", err)
+	}
+}
+
+// Redirect replies to the request with an empty response redirecting to
+// location, which may be a path relative to the host, with the given 3xx
+// status code.
+func Redirect(w ResponseWriter, r *Request, location string, statusCode int) {
+	w.Header()["Location"] = location
+	w.Header()["Content-Length"] = "0"
+	w.WriteHeader(statusCode)
+}
+
+// handler returns the handler serving requests on s, wrapped by the
+// server's middlewares.
+func (s *Server) handler() Handler {
+	var h Handler = FileHandler{}
+	if s.Handler != nil {
+		h = s.Handler
+	}
+	return Chain(h, s.Middleware...)
+}
+
+// serveRequest runs the handler for req, turning a panic into a 500
+// response, or into a cut off body if the response had started, and a
+// closed connection.
+func (s *Server) serveRequest(h Handler, w *responseWriter, req *Request) {
+	defer func() {
+		if err := recover(); err != nil {
+			if err == ErrAbortHandler {
+				req.Logger().Debug("Handler aborted the response", "method", req.Method, "uri", req.RequestURI)
+			} else {
+				req.Logger().Error("Panic serving request", "method", req.Method, "uri", req.RequestURI, "panic", err)
+			}
+			w.closeAfter = true
+			if w.wroteHeader {
+				w.abort()
+			} else {
+				Error(w, req, StatusInternalServerError)
+			}
+		}
+	}()
+	h.ServeTriton(w, req)
+}
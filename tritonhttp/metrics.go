@@ -0,0 +1,241 @@
+package tritonhttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsContentType is the Content-Type of the Prometheus text exposition
+// format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// MetricsPath is the path at which Metrics serves its exposition.
+const MetricsPath = "/metrics"
+
+// durationBuckets are the upper bounds, in seconds, of the buckets of the
+// request duration histogram.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects counters and histograms about the requests and
+// connections of a Server and serves them in the Prometheus text exposition
+// format. It is a Handler, typically served by a second Server on an admin
+// address:
+//
+//	metrics := tritonhttp.NewMetrics()
+//	s := &tritonhttp.Server{Addr: ":8080", VirtualHosts: vhosts, Metrics: metrics}
+//	admin := &tritonhttp.Server{Addr: "localhost:9090", Handler: metrics}
+//
+// A nil *Metrics records nothing.
+type Metrics struct {
+	mu          sync.Mutex
+	requests    map[requestLabels]uint64
+	bytesSent   map[string]uint64
+	durations   map[string]*histogram
+	accepted    uint64
+	conns       map[connState]int64
+	timeouts    map[string]uint64
+	parseErrors map[int]uint64
+}
+
+// requestLabels identifies a series of tritonhttp_requests_total.
+type requestLabels struct {
+	vhost  string
+	method string
+	status int
+}
+
+// histogram counts observations in the cumulative durationBuckets.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range durationBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// NewMetrics returns an empty set of metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:    make(map[requestLabels]uint64),
+		bytesSent:   make(map[string]uint64),
+		durations:   make(map[string]*histogram),
+		conns:       make(map[connState]int64),
+		timeouts:    make(map[string]uint64),
+		parseErrors: make(map[int]uint64),
+	}
+}
+
+// observeResponse records a response sent for a request to vhost, which is
+// "" if no virtual host matched.
+func (m *Metrics) observeResponse(vhost string, method string, statusCode int, bytesSent int64, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestLabels{vhost, method, statusCode}]++
+	m.bytesSent[vhost] += uint64(bytesSent)
+	h, ok := m.durations[vhost]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.durations[vhost] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+func (m *Metrics) connAccepted() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.accepted++
+}
+
+// addConns adds delta to the number of connections in state.
+func (m *Metrics) addConns(state connState, delta int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conns[state] += delta
+}
+
+// timeout records a connection timing out while idle or while a request
+// was being read.
+func (m *Metrics) timeout(phase string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.timeouts[phase]++
+}
+
+// parseError records a request that ReadRequest rejected with statusCode.
+func (m *Metrics) parseError(statusCode int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.parseErrors[statusCode]++
+}
+
+// ServeTriton serves the metrics at MetricsPath.
+func (m *Metrics) ServeTriton(w ResponseWriter, r *Request) {
+	if r.URL != MetricsPath {
+		Error(w, r, StatusNotFound)
+		return
+	}
+	if r.Method != MethodGet && r.Method != MethodHead {
+		Error(w, r, StatusMethodNotAllowed)
+		return
+	}
+
+	var body bytes.Buffer
+	m.WriteTo(&body)
+	w.Header()["Content-Type"] = metricsContentType
+	w.Header()["Content-Length"] = strconv.Itoa(body.Len())
+	w.WriteHeader(StatusOK)
+	if r.Method != MethodHead {
+		body.WriteTo(w)
+	}
+}
+
+// WriteTo writes the metrics to w in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	m.mu.Lock()
+
+	writeFamily(&b, "tritonhttp_requests_total", "counter", "Responses sent, by virtual host, method and status code.")
+	requests := make([]requestLabels, 0, len(m.requests))
+	for labels := range m.requests {
+		requests = append(requests, labels)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.vhost != b.vhost {
+			return a.vhost < b.vhost
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	for _, labels := range requests {
+		fmt.Fprintf(&b, "tritonhttp_requests_total{vhost=%v,method=%v,status=\"%d\"} %d\n",
+			labelValue(labels.vhost), labelValue(labels.method), labels.status, m.requests[labels])
+	}
+
+	writeFamily(&b, "tritonhttp_response_bytes_total", "counter", "Bytes of response bodies sent, by virtual host.")
+	for _, vhost := range sortedKeys(m.bytesSent) {
+		fmt.Fprintf(&b, "tritonhttp_response_bytes_total{vhost=%v} %d\n", labelValue(vhost), m.bytesSent[vhost])
+	}
+
+	writeFamily(&b, "tritonhttp_request_duration_seconds", "histogram", "Time from reading a request to sending its response, by virtual host.")
+	for _, vhost := range sortedKeys(m.durations) {
+		h := m.durations[vhost]
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(&b, "tritonhttp_request_duration_seconds_bucket{vhost=%v,le=\"%v\"} %d\n",
+				labelValue(vhost), strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(&b, "tritonhttp_request_duration_seconds_bucket{vhost=%v,le=\"+Inf\"} %d\n", labelValue(vhost), h.count)
+		fmt.Fprintf(&b, "tritonhttp_request_duration_seconds_sum{vhost=%v} %v\n", labelValue(vhost), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "tritonhttp_request_duration_seconds_count{vhost=%v} %d\n", labelValue(vhost), h.count)
+	}
+
+	writeFamily(&b, "tritonhttp_connections_accepted_total", "counter", "Connections accepted.")
+	fmt.Fprintf(&b, "tritonhttp_connections_accepted_total %d\n", m.accepted)
+
+	writeFamily(&b, "tritonhttp_connections", "gauge", "Open connections, by whether a request is in progress.")
+	fmt.Fprintf(&b, "tritonhttp_connections{state=\"active\"} %d\n", m.conns[stateActive])
+	fmt.Fprintf(&b, "tritonhttp_connections{state=\"idle\"} %d\n", m.conns[stateIdle])
+
+	writeFamily(&b, "tritonhttp_timeouts_total", "counter", "Connections that timed out, while idle or while reading a request.")
+	for _, phase := range []string{"idle", "request"} {
+		fmt.Fprintf(&b, "tritonhttp_timeouts_total{phase=%q} %d\n", phase, m.timeouts[phase])
+	}
+
+	writeFamily(&b, "tritonhttp_parse_errors_total", "counter", "Requests that could not be parsed, by the status code sent.")
+	for _, code := range sortedKeys(m.parseErrors) {
+		fmt.Fprintf(&b, "tritonhttp_parse_errors_total{status=\"%d\"} %d\n", code, m.parseErrors[code])
+	}
+
+	m.mu.Unlock()
+	return b.WriteTo(w)
+}
+
+// writeFamily writes the HELP and TYPE lines of a metric family.
+func writeFamily(b *bytes.Buffer, name string, typ string, help string) {
+	fmt.Fprintf(b, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+}
+
+// labelValue quotes s as a label value of the exposition format.
+func labelValue(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func sortedKeys[K int | string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
@@ -0,0 +1,152 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// MIMEConfig controls the Content-Type of the static files of a virtual host.
+type MIMEConfig struct {
+	// Types maps file name extensions, including the dot, to media types.
+	// It adds to and overrides builtinMIMETypes, e.g. ".md": "text/x-markdown".
+	Types map[string]string `yaml:"types,omitempty"`
+
+	// Default is the media type of files whose type is otherwise unknown.
+	// Empty means application/octet-stream.
+	Default string `yaml:"default"`
+
+	// Charset is added to text/* media types that do not name one. Empty
+	// means utf-8, and "none" leaves them without a charset.
+	Charset string `yaml:"charset"`
+
+	// Sniff determines the type of files with an unknown extension from
+	// their first 512 bytes before falling back to Default.
+	Sniff bool `yaml:"sniff"`
+}
+
+const (
+	defaultMIMEType = "application/octet-stream"
+	defaultCharset  = "utf-8"
+)
+
+// sniffLen is the number of bytes http.DetectContentType looks at.
+const sniffLen = 512
+
+// builtinMIMETypes maps file name extensions to media types. Unlike
+// mime.TypeByExtension it does not depend on the mime.types files of the
+// host, so every server sends the same Content-Type.
+var builtinMIMETypes = map[string]string{
+	".avif":        "image/avif",
+	".bmp":         "image/bmp",
+	".css":         "text/css",
+	".csv":         "text/csv",
+	".gif":         "image/gif",
+	".gz":          "application/gzip",
+	".htm":         "text/html",
+	".html":        "text/html",
+	".ico":         "image/vnd.microsoft.icon",
+	".ics":         "text/calendar",
+	".jpeg":        "image/jpeg",
+	".jpg":         "image/jpeg",
+	".js":          "text/javascript",
+	".json":        "application/json",
+	".map":         "application/json",
+	".md":          "text/markdown",
+	".mjs":         "text/javascript",
+	".mp3":         "audio/mpeg",
+	".mp4":         "video/mp4",
+	".oga":         "audio/ogg",
+	".ogg":         "audio/ogg",
+	".ogv":         "video/ogg",
+	".otf":         "font/otf",
+	".pdf":         "application/pdf",
+	".png":         "image/png",
+	".svg":         "image/svg+xml",
+	".tar":         "application/x-tar",
+	".ttf":         "font/ttf",
+	".txt":         "text/plain",
+	".wasm":        "application/wasm",
+	".wav":         "audio/wav",
+	".webm":        "video/webm",
+	".webmanifest": "application/manifest+json",
+	".webp":        "image/webp",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".xml":         "text/xml",
+	".yaml":        "application/yaml",
+	".yml":         "application/yaml",
+	".zip":         "application/zip",
+}
+
+func (c MIMEConfig) valid() error {
+	for ext, mediaType := range c.Types {
+		if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("extension %q does not start with a dot", ext)
+		}
+		if _, _, err := mime.ParseMediaType(mediaType); err != nil {
+			return fmt.Errorf("invalid media type %q for %v: %w", mediaType, ext, err)
+		}
+	}
+	if c.Default != "" {
+		if _, _, err := mime.ParseMediaType(c.Default); err != nil {
+			return fmt.Errorf("invalid default media type %q: %w", c.Default, err)
+		}
+	}
+	return nil
+}
+
+// contentType returns the Content-Type of the file with the given name.
+// If Sniff is set and the extension is unknown, the type is detected from
+// the start of content, which may be nil.
+func (c MIMEConfig) contentType(name string, content io.ReaderAt) string {
+	ext := filepath.Ext(name)
+	mediaType, ok := c.Types[ext]
+	if !ok {
+		mediaType, ok = c.Types[strings.ToLower(ext)]
+	}
+	if !ok {
+		mediaType = builtinMIMETypes[strings.ToLower(ext)]
+	}
+
+	if mediaType == "" && c.Sniff && content != nil {
+		buf := make([]byte, sniffLen)
+		n, err := content.ReadAt(buf, 0)
+		if n > 0 && (err == nil || err == io.EOF) {
+			// DetectContentType falls back to application/octet-stream,
+			// which would hide the configured default
+			if detected := http.DetectContentType(buf[:n]); detected != defaultMIMEType {
+				mediaType = detected
+			}
+		}
+	}
+
+	if mediaType == "" {
+		mediaType = c.Default
+	}
+	if mediaType == "" {
+		mediaType = defaultMIMEType
+	}
+	return c.withCharset(mediaType)
+}
+
+// withCharset adds the configured charset to a text/* media type that has
+// no charset parameter.
+func (c MIMEConfig) withCharset(mediaType string) string {
+	charset := c.Charset
+	if charset == "" {
+		charset = defaultCharset
+	}
+	if charset == "none" || !strings.HasPrefix(strings.ToLower(mediaType), "text/") {
+		return mediaType
+	}
+	if _, params, err := mime.ParseMediaType(mediaType); err == nil {
+		if _, ok := params["charset"]; ok {
+			return mediaType
+		}
+	}
+	return mediaType + "; charset=" + charset
+}
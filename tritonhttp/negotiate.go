@@ -0,0 +1,69 @@
+package tritonhttp
+
+import (
+	"strconv"
+	"strings"
+)
+
+// negotiateContentType picks the media type to respond with from offers
+// given the value of an Accept header, following RFC 9110 section 12.5.1.
+// Each offer gets the q-value of the most specific media range matching it,
+// and the offer with the highest q-value wins, ties going to the earlier
+// offer. If the header is empty or accepts none of the offers, the first
+// offer is returned rather than refusing to respond.
+func negotiateContentType(accept string, offers []string) string {
+	type mediaRange struct {
+		typ, subtype string
+		q            float64
+	}
+	var ranges []mediaRange
+	for _, entry := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(entry, ";")
+		typ, subtype, ok := strings.Cut(strings.ToLower(strings.TrimSpace(mediaType)), "/")
+		if !ok {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(name), "q") {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				q = -1
+				break
+			}
+			q = parsed
+		}
+		if q >= 0 {
+			ranges = append(ranges, mediaRange{typ, subtype, q})
+		}
+	}
+
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		typ, subtype, _ := strings.Cut(offer, "/")
+
+		// Exact matches beat type/*, which beats */*
+		q, specificity := 0.0, -1
+		for _, r := range ranges {
+			s := -1
+			switch {
+			case r.typ == typ && r.subtype == subtype:
+				s = 2
+			case r.typ == typ && r.subtype == "*":
+				s = 1
+			case r.typ == "*" && r.subtype == "*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = r.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package tritonhttp
+
+import "os"
+
+// fileOwner reports false because file ownership is not available on this
+// platform, so SymlinksIfOwnerMatch never follows a link.
+func fileOwner(info os.FileInfo) (uint32, bool) {
+	return 0, false
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package tritonhttp
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the user ID owning the file described by info.
+func fileOwner(info os.FileInfo) (uint32, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return stat.Uid, true
+}
@@ -0,0 +1,174 @@
+package tritonhttp
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// errUnsatisfiableRange is returned by parseRange when none of the requested
+// ranges overlaps the file.
+var errUnsatisfiableRange = errors.New("range not satisfiable")
+
+// byteRange is an inclusive range of byte offsets, as used by the Range and
+// Content-Range headers.
+type byteRange struct {
+	start, end int64
+}
+
+func (br byteRange) length() int64 {
+	return br.end - br.start + 1
+}
+
+// contentRange returns the Content-Range header value for br in a
+// representation of the given size.
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.end, size)
+}
+
+// parseRange parses a Range header value such as "bytes=0-499, -500" for a
+// representation of the given size. Ranges that start past the end of the
+// file are dropped; if none remain, errUnsatisfiableRange is returned. Any
+// other error means the header is malformed and should be ignored.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, fmt.Errorf("unsupported range unit in %q", header)
+	}
+
+	var ranges []byteRange
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid range %q", part)
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var r byteRange
+		if first == "" {
+			// Suffix range: the last n bytes
+			n, err := parseRangePos(last)
+			if err != nil {
+				return nil, fmt.Errorf("invalid range %q", part)
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			r = byteRange{start: max(size-n, 0), end: size - 1}
+		} else {
+			start, err := parseRangePos(first)
+			if err != nil {
+				return nil, fmt.Errorf("invalid range %q", part)
+			}
+			end := size - 1
+			if last != "" {
+				end, err = parseRangePos(last)
+				if err != nil || end < start {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+				end = min(end, size-1)
+			}
+			if start >= size {
+				continue
+			}
+			r = byteRange{start: start, end: end}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+// parseRangePos parses a position of a byte range, which is made of digits
+// only; strconv.ParseInt alone would also take a sign.
+func parseRangePos(s string) (int64, error) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid range position %q", s)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// ifRangeMatch reports whether the If-Range precondition of req holds for a
+// file with the given validators, i.e. whether its Range header applies.
+// If-Range only accepts a strong entity tag or an exact modification date.
+func ifRangeMatch(req *Request, etag string, lastModified string) bool {
+	ifRange, ok := req.Headers["If-Range"]
+	if !ok {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || isWeakETag(ifRange) {
+		return etagMatch(ifRange, etag, true)
+	}
+	return ifRange == lastModified
+}
+
+// newBoundary returns a random boundary for a multipart/byteranges body.
+func newBoundary() string {
+	var buf [16]byte
+	if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", buf[:])
+}
+
+// multipartPartHeader returns the boundary delimiter and headers preceding
+// the body part for r in a multipart/byteranges response. Each body part is
+// followed by a CRLF.
+func multipartPartHeader(boundary string, contentType string, r byteRange, size int64) string {
+	header := "--" + boundary + "\r\n"
+	if contentType != "" {
+		header += "Content-Type: " + contentType + "\r\n"
+	}
+	header += "Content-Range: " + r.contentRange(size) + "\r\n\r\n"
+	return header
+}
+
+// multipartTrailer returns the closing delimiter of a multipart/byteranges body.
+func multipartTrailer(boundary string) string {
+	return "--" + boundary + "--\r\n"
+}
+
+// multipartLength returns the exact length of the multipart/byteranges body
+// written by writeMultipartRanges, for the Content-Length header.
+func multipartLength(boundary string, contentType string, ranges []byteRange, size int64) int64 {
+	var length int64
+	for _, r := range ranges {
+		length += int64(len(multipartPartHeader(boundary, contentType, r, size))) + r.length() + 2
+	}
+	return length + int64(len(multipartTrailer(boundary)))
+}
+
+// writeRange copies the bytes of file covered by r to w.
+func writeRange(w io.Writer, file *os.File, r byteRange) error {
+	_, err := io.Copy(w, io.NewSectionReader(file, r.start, r.length()))
+	return err
+}
+
+// writeMultipartRanges writes a multipart/byteranges body with one part per
+// range of file to w.
+func writeMultipartRanges(w io.Writer, file *os.File, boundary string, contentType string, ranges []byteRange, size int64) error {
+	for _, r := range ranges {
+		if _, err := io.WriteString(w, multipartPartHeader(boundary, contentType, r, size)); err != nil {
+			return err
+		}
+		if err := writeRange(w, file, r); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "\r\n"); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, multipartTrailer(boundary))
+	return err
+}
@@ -3,28 +3,121 @@ package tritonhttp
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+	"net/url"
 	"strings"
 	"time"
 	"unicode"
 )
 
 type Request struct {
-	Method   string // e.g. "GET"
-	URL      string // e.g. "/path/to/a/file"
+	Method   string // e.g. "GET" or "HEAD"
+	URL      string // e.g. "/path/to/a/file", percent-decoded
 	Protocol string // e.g. "HTTP/1.1"
 
+	// RequestURI is the unmodified request target sent by the client,
+	// e.g. "/my%20file.html?v=3" or "http://website1/".
+	RequestURI string
+
+	RawPath  string     // the path as sent, still percent-encoded, e.g. "/my%20file.html"
+	RawQuery string     // the query without the "?", e.g. "v=3"
+	Query    url.Values // the parsed RawQuery
+
 	// Headers stores the key-value HTTP headers
 	Headers map[string]string
 
 	Host  string // determine from the "Host" header
 	Close bool   // determine from the "Connection" header
+
+	// Body is the request body, read according to the Content-Length or
+	// chunked Transfer-Encoding header. It is NoBody if there is none.
+	// Whatever the handler leaves unread is discarded by the server.
+	Body io.Reader
+
+	// ContentLength is the length of Body, or -1 if it is chunked.
+	ContentLength int64
+
+	// Trailer holds the trailer fields of a chunked body. It is filled in
+	// once Body has been read to EOF.
+	Trailer map[string]string
+
+	// VirtualHost is the virtual host matching Host, set by the server
+	// before calling the Handler. It is nil if no virtual host matches.
+	VirtualHost *VirtualHost
+
+	// TLS is the state of the TLS connection the request arrived on, or nil
+	// if it arrived in plaintext.
+	TLS *tls.ConnectionState
+
+	logger *slog.Logger
+}
+
+// Logger returns the logger of the server that received r, carrying the ID
+// of its connection and its sequence number on that connection, or the
+// default logger if r did not come from a Server.
+func (r *Request) Logger() *slog.Logger {
+	if r == nil || r.logger == nil {
+		return slog.Default()
+	}
+	return r.logger
+}
+
+const (
+	MethodGet  = "GET"
+	MethodHead = "HEAD"
+)
+
+// allowedMethods is the value of the Allow header sent with 405 responses
+// by FileHandler.
+const allowedMethods = MethodGet + ", " + MethodHead
+
+// knownHTTPMethods lists the standard methods besides GET and HEAD that are
+// passed on to the Handler; any other method is answered with 501.
+var knownHTTPMethods = map[string]bool{
+	"POST":    true,
+	"PUT":     true,
+	"DELETE":  true,
+	"CONNECT": true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PATCH":   true,
+}
+
+// statusError is a request error that should be answered with a status
+// code other than 400 Bad Request.
+type statusError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *statusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.Err
 }
 
 func validHTTPMethod(method string) bool {
-	return method == "GET"
+	return method == MethodGet || method == MethodHead || knownHTTPMethods[method]
+}
+
+// validHTTPToken reports whether s is a non-empty RFC 9110 token, the syntax
+// of a request method.
+func validHTTPToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c > unicode.MaxASCII || !(unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+	return true
 }
 
 func validHTTPVersion(version string) bool {
@@ -52,15 +145,65 @@ func validHTTPHeader(key string, value string) bool {
 
 // The URL specifies the location of the resource the client is interested in. Examples include
 // /images/myimg.jpg and /classes/fall/cs101/index.html. A well-formed URL always starts with a /
-// character. If the slash is missing, send back a 400 error.
+// character, unless it is in absolute form (http://website1/index.html) as RFC 9112 requires
+// servers to accept. Otherwise, send back a 400 error.
 func validURL(url string) bool {
-	return strings.HasPrefix(url, "/")
+	return strings.HasPrefix(url, "/") || strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
 }
 
-// ReadRequest reads and parses an incoming request from br.
+// parseTarget splits the request target into its percent-decoded path and
+// its query. For an absolute-form target it returns the authority, which
+// takes the place of the Host header; otherwise the returned host is "".
+func (r *Request) parseTarget() (host string, err error) {
+	if !validURL(r.RequestURI) {
+		return "", fmt.Errorf("invalid URL: %q", r.RequestURI)
+	}
+
+	u, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %q: %w", r.RequestURI, err)
+	}
+	if u.IsAbs() && (u.Host == "" || u.User != nil) {
+		return "", fmt.Errorf("invalid absolute URL: %q", r.RequestURI)
+	}
+	if strings.ContainsRune(u.Path, 0) {
+		return "", fmt.Errorf("URL contains an encoded NUL: %q", r.RequestURI)
+	}
+
+	r.URL = u.Path
+	if r.URL == "" {
+		r.URL = "/"
+	}
+	r.RawPath = u.EscapedPath()
+	if r.RawPath == "" {
+		r.RawPath = "/"
+	}
+	r.RawQuery = u.RawQuery
+	// Malformed pairs are dropped; the rest of the query is still usable
+	r.Query, _ = url.ParseQuery(u.RawQuery)
+
+	return u.Host, nil
+}
+
+// hasEncodedSlash reports whether the escaped path contains a
+// percent-encoded slash, which decodes to a path separator.
+func hasEncodedSlash(rawPath string) bool {
+	return strings.Contains(strings.ToLower(rawPath), "%2f")
+}
+
+// ReadRequest reads and parses an incoming request from br, waiting up to
+// READ_TIMEOUT for each byte and READ_HEADER_TIMEOUT for all the headers.
 func ReadRequest(conn net.Conn, br *bufio.Reader) (request *Request, bytesRead int, err error) {
+	return readRequest(conn, br, slog.Default(), READ_TIMEOUT, READ_HEADER_TIMEOUT)
+}
+
+// readRequest is ReadRequest with the given logger, which becomes the
+// logger of the request, and the given timeouts. The read timeout also
+// applies to the body.
+func readRequest(conn net.Conn, br *bufio.Reader, logger *slog.Logger, timeout time.Duration, headerTimeout time.Duration) (request *Request, bytesRead int, err error) {
 	bytesRead = 0
-	line, err := ReadLine(conn, br)
+	headerDeadline := time.Now().Add(headerTimeout)
+	line, err := readLine(conn, br, logger, timeout, headerDeadline)
 	bytesRead += len(line)
 	if err != nil {
 		return nil, bytesRead, err
@@ -71,11 +214,11 @@ func ReadRequest(conn net.Conn, br *bufio.Reader) (request *Request, bytesRead i
 		return nil, bytesRead, fmt.Errorf("invalid start line, got %v", line)
 	}
 
-	request = &Request{Method: fields[0], URL: fields[1], Protocol: fields[2], Headers: make(map[string]string)}
+	request = &Request{Method: fields[0], RequestURI: fields[1], Protocol: fields[2], Headers: make(map[string]string), logger: logger}
 
 	// Read other lines of requests
 	for {
-		line, err := ReadLine(conn, br)
+		line, err := readLine(conn, br, logger, timeout, headerDeadline)
 		bytesRead += len(line)
 		if err != nil {
 			return nil, bytesRead, err
@@ -95,6 +238,12 @@ func ReadRequest(conn net.Conn, br *bufio.Reader) (request *Request, bytesRead i
 			return nil, bytesRead, fmt.Errorf("invalid HTTP header: %q", line)
 		}
 
+		// Repeated framing headers could make us disagree with an intermediary
+		// about where the body ends
+		if prev, ok := request.Headers[key]; ok && prev != value && (key == "Content-Length" || key == "Transfer-Encoding") {
+			return nil, bytesRead, fmt.Errorf("conflicting %v headers: %q and %q", key, prev, value)
+		}
+
 		request.Headers[key] = value
 		if key == "Host" {
 			request.Host = value
@@ -108,19 +257,18 @@ func ReadRequest(conn net.Conn, br *bufio.Reader) (request *Request, bytesRead i
 		return nil, bytesRead, fmt.Errorf("invalid HTTP version: %q", request.Protocol)
 	}
 
-	// HTTP method must be GET
-	if !validHTTPMethod(request.Method) {
+	// HTTP method must be a standard one
+	if !validHTTPToken(request.Method) {
 		return nil, bytesRead, fmt.Errorf("invalid HTTP method: %q", request.Method)
 	}
-
-	// Check the URL
-	if !validURL(request.URL) {
-		return nil, bytesRead, fmt.Errorf("invalid URL: %q", request.URL)
+	if !validHTTPMethod(request.Method) {
+		return nil, bytesRead, &statusError{StatusNotImplemented, fmt.Errorf("unsupported HTTP method: %q", request.Method)}
 	}
 
-	// Append index.html to the URL if it ends with a slash
-	if strings.HasSuffix(request.URL, "/") {
-		request.URL += "index.html"
+	// Check and decode the URL
+	targetHost, err := request.parseTarget()
+	if err != nil {
+		return nil, bytesRead, err
 	}
 
 	// Host header must be present
@@ -128,6 +276,16 @@ func ReadRequest(conn net.Conn, br *bufio.Reader) (request *Request, bytesRead i
 		return nil, bytesRead, fmt.Errorf("missing Host header")
 	}
 
+	// The authority of an absolute-form URL overrides the Host header
+	if targetHost != "" {
+		request.Host = targetHost
+	}
+
+	// Set up the body, which the handler reads from br
+	if err := request.setBody(conn, br, logger, timeout); err != nil {
+		return nil, bytesRead, err
+	}
+
 	return request, bytesRead, nil
 }
 
@@ -149,12 +307,24 @@ func parseHTTPHeader(line string) (string, string, error) {
 	return key, value, nil
 }
 
+// ReadLine reads a line ending in CRLF from br and returns it without the
+// CRLF, waiting up to READ_TIMEOUT for each byte.
 func ReadLine(conn net.Conn, br *bufio.Reader) (string, error) {
+	return readLine(conn, br, slog.Default(), READ_TIMEOUT, time.Time{})
+}
+
+// readLine is ReadLine logging to logger, with the given timeout for each
+// byte, and a deadline for the whole line unless it is zero.
+func readLine(conn net.Conn, br *bufio.Reader, logger *slog.Logger, timeout time.Duration, deadline time.Time) (string, error) {
 	var line []byte
 	for {
 		// Set timeout
-		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
-			log.Printf("Failed to set timeout for connection %v", conn)
+		byteDeadline := time.Now().Add(timeout)
+		if !deadline.IsZero() && deadline.Before(byteDeadline) {
+			byteDeadline = deadline
+		}
+		if err := conn.SetReadDeadline(byteDeadline); err != nil {
+			logger.Debug("Failed to set read deadline", "err", err)
 			conn.Close()
 			return string(line), err
 		}
@@ -3,12 +3,8 @@ package tritonhttp
 import (
 	"fmt"
 	"io"
-	"log"
-	"mime"
-	"os"
-	"path/filepath"
 	"sort"
-	"strings"
+	"strconv"
 	"time"
 )
 
@@ -25,67 +21,55 @@ type Response struct {
 	// Hint: you might need this to handle the "Connection: Close" requirement
 	Request *Request
 
-	// FilePath is the local path to the file to serve.
-	// It could be "", which means there is no file to serve.
-	FilePath string
+	// Body is written after the headers.
+	Body []byte
 }
 
 // NewResponse create new instance of Response with the given request and status code.
-func NewResponse(s *Server, request *Request, statusCode int) Response {
+// The server uses it to answer requests that never reach a Handler, such as malformed
+// ones, so error responses get the built-in error page as their body.
+func NewResponse(request *Request, statusCode int) Response {
 	r := Response{
 		Proto:      "HTTP/1.1",
 		StatusCode: statusCode,
 		StatusText: StatusCodeText[statusCode],
 		Headers:    make(map[string]string),
 		Request:    request,
-		FilePath:   "",
 	}
 	r.Headers["Date"] = FormatTime(time.Now())
-	if statusCode == 400 || request.Close {
+	if statusCode == 400 || request == nil || request.Close {
 		r.Headers["Connection"] = "close"
 	}
-	if statusCode == 200 {
-		r.FilePath = filepath.Clean(s.VirtualHosts[request.Host] + request.URL)
-		if !strings.HasPrefix(r.FilePath, s.VirtualHosts[request.Host]) {
-			log.Printf("Trying to access file: %v outside document root: %v", r.FilePath, s.VirtualHosts[request.Host])
-			r.StatusCode = 404
-			r.StatusText = StatusCodeText[404]
-			r.FilePath = ""
-			return r
-		}
-
-		fileinfo, err := os.Stat(r.FilePath)
-		if err != nil {
-			log.Printf("Error getting file info: %v", err)
-			r.StatusCode = 404
-			r.StatusText = StatusCodeText[404]
-			r.FilePath = ""
-			return r
-		}
-
-		r.Headers["Content-Length"] = fmt.Sprintf("%v", fileinfo.Size())
-		r.Headers["Content-Type"] = mime.TypeByExtension(filepath.Ext(r.FilePath))
-		r.Headers["Last-Modified"] = FormatTime(fileinfo.ModTime())
+	if statusCode == StatusMethodNotAllowed {
+		r.Headers["Allow"] = allowedMethods
+	}
+	if statusCode >= 400 {
+		contentType, body := errorBody(request, statusCode)
+		r.Headers["Content-Type"] = contentType
+		r.Headers["Content-Length"] = strconv.Itoa(len(body))
+		r.Body = body
 	}
 	return r
 }
 
-func (res *Response) Write(w io.Writer) error {
+// writeHeader writes the status line and the headers, sorted by key,
+// followed by the blank line that ends them.
+func writeHeader(w io.Writer, proto string, statusCode int, headers map[string]string) error {
 	// Write status line
-	statusLine := fmt.Sprintf("%v %v %v\r\n", res.Proto, res.StatusCode, StatusCodeText[res.StatusCode])
+	statusLine := fmt.Sprintf("%v %v %v\r\n", proto, statusCode, StatusCodeText[statusCode])
 	if _, err := fmt.Fprint(w, statusLine); err != nil {
 		return err
 	}
 
 	// Write headers sorted by keys
-	keys := make([]string, 0, len(res.Headers))
-	for key := range res.Headers {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
 		keys = append(keys, key)
 	}
 	sort.Strings(keys)
 
 	for _, key := range keys {
-		value := res.Headers[key]
+		value := headers[key]
 		headerLine := fmt.Sprintf("%v: %v\r\n", key, value)
 		if _, err := fmt.Fprint(w, headerLine); err != nil {
 			return err
@@ -96,23 +80,18 @@ func (res *Response) Write(w io.Writer) error {
 	if _, err := fmt.Fprintf(w, "\r\n"); err != nil {
 		return err
 	}
+	return nil
+}
 
-	// Write body if there is any
-	if res.FilePath == "" {
-		return nil
-	}
-
-	// Open file to serve
-	file, err := os.Open(res.FilePath)
-	if err != nil {
+func (res *Response) Write(w io.Writer) error {
+	if err := writeHeader(w, res.Proto, res.StatusCode, res.Headers); err != nil {
 		return err
 	}
-	defer file.Close()
 
-	// Write file contents directly to the provided writer
-	if _, err := io.Copy(w, file); err != nil {
-		return err
+	// Write body if there is any; a HEAD response carries only the headers
+	if res.Request != nil && res.Request.Method == MethodHead {
+		return nil
 	}
-
-	return nil
+	_, err := w.Write(res.Body)
+	return err
 }
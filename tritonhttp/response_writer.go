@@ -0,0 +1,279 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrBodyNotAllowed is returned by ResponseWriter.Write when the status
+	// code of the response does not permit a body.
+	ErrBodyNotAllowed = errors.New("tritonhttp: request method or response status code does not allow body")
+
+	// ErrContentLength is returned by ResponseWriter.Write when the handler
+	// writes more than the Content-Length it declared.
+	ErrContentLength = errors.New("tritonhttp: wrote more than the declared Content-Length")
+
+	// ErrAbortHandler is a panic value a handler can use to abort a response
+	// it cannot complete. The client sees the body cut off rather than a
+	// complete response, and the panic is not logged as an error.
+	ErrAbortHandler = errors.New("tritonhttp: abort Handler")
+)
+
+// A ResponseWriter is used by a Handler to construct a response.
+type ResponseWriter interface {
+	// Header returns the headers that WriteHeader will send. Changing
+	// them after WriteHeader has no effect.
+	Header() map[string]string
+
+	// WriteHeader sends the status line and headers with the given status
+	// code. Only the first call has an effect.
+	WriteHeader(statusCode int)
+
+	// Write writes data as part of the body, calling WriteHeader(StatusOK)
+	// first if WriteHeader has not yet been called. The data is discarded
+	// for HEAD requests.
+	Write(p []byte) (int, error)
+
+	// Flush sends any buffered data to the client, calling
+	// WriteHeader(StatusOK) first if WriteHeader has not yet been called.
+	Flush() error
+}
+
+// responseWriter is the ResponseWriter handed to handlers by
+// HandleConnection. A response without a Content-Length header is sent with
+// chunked Transfer-Encoding, so the connection can still be reused.
+//
+// Trailers are declared by listing their names in the "Trailer" header
+// before WriteHeader, and their values are set in Header() by the time the
+// handler returns. They are only sent with a chunked body.
+type responseWriter struct {
+	w   *bufio.Writer
+	req *Request
+
+	header      map[string]string
+	statusCode  int
+	wroteHeader bool
+
+	contentLength int64 // -1 if unknown
+	written       int64
+	chunked       bool
+	trailers      []string // canonical names declared in the Trailer header
+
+	// closeAfter is set if the connection cannot be reused after this response
+	closeAfter bool
+
+	// aborted is set if the body was cut short by a failed write or a
+	// panic. A chunked body then goes without its last chunk, so the client
+	// does not take it for a complete one.
+	aborted bool
+
+	// keepAlive is how long the connection stays open for the next request,
+	// advertised in the Keep-Alive header if at least a second
+	keepAlive time.Duration
+}
+
+func newResponseWriter(w io.Writer, req *Request) *responseWriter {
+	header := make(map[string]string)
+	// Headers of the virtual host go on every response, unless the
+	// handler replaces them
+	if req.VirtualHost != nil {
+		for key, value := range req.VirtualHost.Headers {
+			header[CanonicalHeaderKey(key)] = value
+		}
+	}
+	return &responseWriter{
+		w:             bufio.NewWriter(w),
+		req:           req,
+		header:        header,
+		contentLength: -1,
+		closeAfter:    req.Close,
+	}
+}
+
+func (w *responseWriter) Header() map[string]string {
+	return w.header
+}
+
+// bodyAllowed reports whether a response with the given status may have a body.
+func bodyAllowed(statusCode int) bool {
+	return !(statusCode >= 100 && statusCode < 200) && statusCode != StatusNoContent && statusCode != StatusNotModified
+}
+
+func (w *responseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		w.req.Logger().Warn("Superfluous WriteHeader", "status", statusCode, "method", w.req.Method, "uri", w.req.RequestURI)
+		return
+	}
+	w.wroteHeader = true
+	w.statusCode = statusCode
+
+	if _, ok := w.header["Date"]; !ok {
+		w.header["Date"] = FormatTime(time.Now())
+	}
+
+	if cl, ok := w.header["Content-Length"]; ok {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < 0 {
+			w.req.Logger().Warn("Dropping invalid Content-Length", "contentLength", cl)
+			delete(w.header, "Content-Length")
+		} else {
+			w.contentLength = n
+		}
+	}
+
+	// Without a length the body is sent in chunks, which may be followed
+	// by trailers
+	delete(w.header, "Transfer-Encoding")
+	if w.contentLength < 0 && bodyAllowed(statusCode) {
+		w.chunked = true
+		w.header["Transfer-Encoding"] = "chunked"
+	}
+	if declared, ok := w.header["Trailer"]; ok {
+		delete(w.header, "Trailer")
+		if w.chunked {
+			w.setTrailers(declared)
+		}
+	}
+	if w.header["Connection"] == "close" {
+		w.closeAfter = true
+	}
+	if w.closeAfter {
+		w.header["Connection"] = "close"
+		delete(w.header, "Keep-Alive")
+	} else if seconds := int64(w.keepAlive / time.Second); seconds > 0 {
+		w.header["Keep-Alive"] = "timeout=" + strconv.FormatInt(seconds, 10)
+	}
+
+	if err := writeHeader(w.w, "HTTP/1.1", statusCode, w.header); err != nil {
+		w.req.Logger().Debug("Failed to write response header", "err", err)
+		w.closeAfter = true
+	}
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(StatusOK)
+	}
+	if !bodyAllowed(w.statusCode) {
+		return 0, ErrBodyNotAllowed
+	}
+	if w.req.Method == MethodHead {
+		return len(p), nil
+	}
+	if w.contentLength >= 0 && w.written+int64(len(p)) > w.contentLength {
+		return 0, ErrContentLength
+	}
+
+	if w.chunked {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		if _, err := fmt.Fprintf(w.w, "%x\r\n", len(p)); err != nil {
+			w.abort()
+			return 0, err
+		}
+	}
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	if err == nil && w.chunked {
+		_, err = io.WriteString(w.w, "\r\n")
+	}
+	if err != nil {
+		w.abort()
+	}
+	return n, err
+}
+
+func (w *responseWriter) Flush() error {
+	if !w.wroteHeader {
+		w.WriteHeader(StatusOK)
+	}
+	if err := w.w.Flush(); err != nil {
+		w.abort()
+		return err
+	}
+	return nil
+}
+
+// abort marks the body as cut short; the connection cannot be reused.
+func (w *responseWriter) abort() {
+	w.aborted = true
+	w.closeAfter = true
+}
+
+// setTrailers records the trailer names declared in the Trailer header and
+// advertises them to the client. Their values are held back from the
+// header block until the end of the body.
+func (w *responseWriter) setTrailers(declared string) {
+	var names []string
+	for _, name := range strings.Split(declared, ",") {
+		name = CanonicalHeaderKey(strings.TrimSpace(name))
+		switch name {
+		case "", "Content-Length", "Transfer-Encoding", "Trailer":
+			continue
+		}
+		w.trailers = append(w.trailers, name)
+		names = append(names, name)
+		delete(w.header, name)
+	}
+	if len(names) > 0 {
+		w.header["Trailer"] = strings.Join(names, ", ")
+	}
+}
+
+// writeTrailer ends a chunked body with the last chunk and the trailers.
+func (w *responseWriter) writeTrailer() error {
+	if _, err := io.WriteString(w.w, "0\r\n"); err != nil {
+		return err
+	}
+	for _, name := range w.trailers {
+		if value, ok := w.header[name]; ok {
+			if _, err := fmt.Fprintf(w.w, "%v: %v\r\n", name, value); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := io.WriteString(w.w, "\r\n")
+	return err
+}
+
+// finish completes the response after the handler returns and flushes it
+// to the connection.
+func (w *responseWriter) finish() error {
+	if !w.wroteHeader {
+		if _, ok := w.header["Content-Length"]; !ok {
+			w.header["Content-Length"] = "0"
+		}
+		w.WriteHeader(StatusOK)
+	}
+
+	if w.chunked {
+		if w.aborted {
+			return w.w.Flush()
+		}
+		if w.req.Method != MethodHead {
+			if err := w.writeTrailer(); err != nil {
+				w.closeAfter = true
+				return err
+			}
+		}
+		return w.w.Flush()
+	}
+
+	// A body shorter than its Content-Length leaves the client waiting
+	if w.contentLength >= 0 && w.written < w.contentLength && w.req.Method != MethodHead && bodyAllowed(w.statusCode) {
+		w.closeAfter = true
+		if err := w.w.Flush(); err != nil {
+			return err
+		}
+		return fmt.Errorf("handler wrote %v of %v bytes declared in Content-Length", w.written, w.contentLength)
+	}
+
+	return w.w.Flush()
+}
@@ -2,140 +2,710 @@ package tritonhttp
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net"
-	"os"
-	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	StatusOK         = 200
-	StatusBadRequest = 400
-	StatusNotFound   = 404
-	TCP              = "tcp"
+	StatusOK                   = 200
+	StatusCreated              = 201
+	StatusAccepted             = 202
+	StatusNoContent            = 204
+	StatusPartialContent       = 206
+	StatusMovedPermanently     = 301
+	StatusFound                = 302
+	StatusSeeOther             = 303
+	StatusNotModified          = 304
+	StatusTemporaryRedirect    = 307
+	StatusPermanentRedirect    = 308
+	StatusBadRequest           = 400
+	StatusUnauthorized         = 401
+	StatusForbidden            = 403
+	StatusNotFound             = 404
+	StatusMethodNotAllowed     = 405
+	StatusRequestTimeout       = 408
+	StatusConflict             = 409
+	StatusGone                 = 410
+	StatusPreconditionFailed   = 412
+	StatusPayloadTooLarge      = 413
+	StatusUnsupportedMediaType = 415
+	StatusRangeNotSatisfiable  = 416
+	StatusMisdirectedRequest   = 421
+	StatusTooManyRequests      = 429
+	StatusInternalServerError  = 500
+	StatusNotImplemented       = 501
+	StatusBadGateway           = 502
+	StatusServiceUnavailable   = 503
+	StatusGatewayTimeout       = 504
+	TCP                        = "tcp"
 )
 
 var StatusCodeText = map[int]string{
-	StatusOK:         "OK",
-	StatusBadRequest: "Bad Request",
-	StatusNotFound:   "Not Found",
+	StatusOK:                   "OK",
+	StatusCreated:              "Created",
+	StatusAccepted:             "Accepted",
+	StatusNoContent:            "No Content",
+	StatusPartialContent:       "Partial Content",
+	StatusMovedPermanently:     "Moved Permanently",
+	StatusFound:                "Found",
+	StatusSeeOther:             "See Other",
+	StatusNotModified:          "Not Modified",
+	StatusTemporaryRedirect:    "Temporary Redirect",
+	StatusPermanentRedirect:    "Permanent Redirect",
+	StatusBadRequest:           "Bad Request",
+	StatusUnauthorized:         "Unauthorized",
+	StatusForbidden:            "Forbidden",
+	StatusNotFound:             "Not Found",
+	StatusMethodNotAllowed:     "Method Not Allowed",
+	StatusRequestTimeout:       "Request Timeout",
+	StatusConflict:             "Conflict",
+	StatusGone:                 "Gone",
+	StatusPreconditionFailed:   "Precondition Failed",
+	StatusPayloadTooLarge:      "Payload Too Large",
+	StatusUnsupportedMediaType: "Unsupported Media Type",
+	StatusRangeNotSatisfiable:  "Range Not Satisfiable",
+	StatusMisdirectedRequest:   "Misdirected Request",
+	StatusTooManyRequests:      "Too Many Requests",
+	StatusInternalServerError:  "Internal Server Error",
+	StatusNotImplemented:       "Not Implemented",
+	StatusBadGateway:           "Bad Gateway",
+	StatusServiceUnavailable:   "Service Unavailable",
+	StatusGatewayTimeout:       "Gateway Timeout",
 }
 
+// ErrServerClosed is returned by Serve and ListenAndServe after a call to Shutdown.
+var ErrServerClosed = errors.New("tritonhttp: Server closed")
+
+// shutdownPollInterval is how often Shutdown checks for idle connections
+// while waiting for active ones to finish.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// connState tells Shutdown whether a connection is in the middle of a
+// request (active) or waiting for the next one (idle).
+type connState int
+
+const (
+	stateActive connState = iota
+	stateIdle
+)
+
 type Server struct {
 	// Addr specifies the TCP address for the server to listen on,
 	// in the form "host:port". It shall be passed to net.Listen()
 	// during ListenAndServe().
 	Addr string // e.g. ":0"
 
-	// VirtualHosts contains a mapping from host name to the docRoot path
-	// (i.e. the path to the directory to serve static files from) for
-	// all virtual hosts that this server supports
-	VirtualHosts map[string]string
-}
+	// TLSAddr is the TCP address for ListenAndServeTLS to listen on for
+	// HTTPS, e.g. ":8443". It also gives the port of redirects to HTTPS.
+	TLSAddr string
 
-// ListenAndServe listens on the TCP network address s.Addr and then
-// handles requests on incoming connections.
-func (s *Server) ListenAndServe() error {
+	// TLSConfig optionally provides the TLS configuration used by ServeTLS,
+	// such as the minimum version. Unless it sets certificates itself, the
+	// certificate is chosen by SNI among those of VirtualHosts.
+	TLSConfig *tls.Config
 
-	// Validate all docRoots
-	for _, docRoot := range s.VirtualHosts {
-		// Shortest path name equivalent to path by *purely lexical processing*
-		docrootPath := filepath.Clean(docRoot)
+	// RedirectToHTTPS makes the server answer every request on a plaintext
+	// connection with a 301 redirect to the same URL on TLSAddr.
+	RedirectToHTTPS bool
 
-		// Check if the path exists
-		fileInfo, err := os.Stat(docRoot)
-		if err != nil {
-			log.Fatalf("Docroot %s does not exist: %v", docRoot, err)
-		}
+	// VirtualHosts contains a mapping from host name to the configuration,
+	// including the docRoot path (i.e. the path to the directory to serve
+	// static files from), of all virtual hosts that this server supports.
+	// It is the configuration the server starts with; use SetVirtualHosts
+	// to replace it while serving.
+	VirtualHosts map[string]VirtualHost
 
-		// Check if the path is a directory
-		if !fileInfo.IsDir() {
-			log.Fatalf("Docroot %s is not a directory", docrootPath)
-		}
+	// Handler responds to requests. If nil, FileHandler serves static
+	// files from the docroots of VirtualHosts.
+	Handler Handler
+
+	// Middleware wraps Handler, the first one outermost, so that requests
+	// can be checked, rewritten or logged without replacing the handler.
+	Middleware []Middleware
+
+	// MaxBodyBytes limits the size of request bodies. A request declaring a
+	// longer Content-Length is answered with 413 Payload Too Large; reading
+	// past the limit of a chunked body returns ErrBodyTooLarge. Zero means
+	// no limit.
+	MaxBodyBytes int64
+
+	// ReadTimeout is how long the server waits for the next bytes of a
+	// request, in its headers or its body. Zero means READ_TIMEOUT.
+	ReadTimeout time.Duration
+
+	// ReadHeaderTimeout is how long the server waits for the whole request
+	// line and headers, from their first byte. Zero means
+	// READ_HEADER_TIMEOUT.
+	ReadHeaderTimeout time.Duration
+
+	// IdleTimeout is how long a keep-alive connection may wait for its next
+	// request. Zero means ReadTimeout. It is advertised to clients in the
+	// Keep-Alive header.
+	IdleTimeout time.Duration
+
+	// WriteTimeout limits the time to write a response, from the end of
+	// reading its request. Zero means no limit.
+	WriteTimeout time.Duration
+
+	// RejectEncodedSlashes makes the server answer requests whose path
+	// contains a percent-encoded slash ("%2F") with 400 Bad Request, rather
+	// than decoding it to a path separator.
+	RejectEncodedSlashes bool
+
+	// AccessLog, if set, records every response the server sends, such as
+	// to an AccessLog in Common Log Format.
+	AccessLog AccessLogger
+
+	// Logger receives the diagnostics of the server. Messages about a
+	// connection carry its ID as "conn" and, once a request has started,
+	// the sequence number of the request on the connection as "req".
+	// Connection chatter is logged at debug level. If nil, slog.Default()
+	// is used.
+	Logger *slog.Logger
+
+	// Metrics, if set, collects counters and histograms about the requests
+	// and connections of the server, to be served by another Server.
+	Metrics *Metrics
+
+	inShutdown atomic.Bool
+	lastConnID atomic.Uint64
+	vhosts     atomic.Pointer[vhostConfig]
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]uint64 // the order in which they were added
+	listenSeq  uint64
+	activeConn map[net.Conn]connState
+}
+
+// ListenAndServe listens on the TCP network address s.Addr and then
+// handles requests on incoming connections. It always returns a non-nil
+// error; after Shutdown the returned error is ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	if s.shuttingDown() {
+		return ErrServerClosed
 	}
 
-	// Server listens on the configured address
-	ln, err := net.Listen(TCP, s.Addr)
+	ln, err := s.Listen()
 	if err != nil {
 		return err
 	}
+	return s.Serve(ln)
+}
+
+// Listen opens a TCP listener on s.Addr without serving on it. It lets the
+// caller learn the bound address (e.g. when s.Addr is ":0") before handing
+// the listener to Serve.
+func (s *Server) Listen() (net.Listener, error) {
+	return net.Listen(TCP, s.Addr)
+}
+
+// Serve accepts incoming connections on ln and handles requests on them,
+// each in a new goroutine. Serve takes ownership of ln and closes it on
+// return. It always returns a non-nil error; after Shutdown the returned
+// error is ErrServerClosed.
+func (s *Server) Serve(ln net.Listener) error {
+	if err := s.initVirtualHosts(); err != nil {
+		ln.Close()
+		return err
+	}
 
 	// Ensure the listener is closed on exit
+	if !s.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
 	defer func() {
-		err = ln.Close()
-		if err != nil {
-			log.Println("Failed to close listener", err)
+		s.trackListener(ln, false)
+		err := ln.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			s.logger().Warn("Failed to close listener", "err", err)
 		}
 	}()
-	log.Println("Listening on", ln.Addr())
+	s.logger().Info("Listening", "addr", ln.Addr().String())
 
 	// Continuously accept new connections
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Println("Failed to accept connection", err)
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			s.logger().Error("Failed to accept connection", "err", err)
 			continue
 		}
 
-		log.Println("Accepted connection from", conn.RemoteAddr())
-
 		// Handle the connection in a new goroutine
 		go s.HandleConnection(conn)
 	}
 }
 
+// ListenAddr returns the address of the listener most recently passed to
+// Serve among those still serving, or nil if the server is not serving.
+func (s *Server) ListenAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var latest net.Listener
+	var latestSeq uint64
+	for ln, seq := range s.listeners {
+		if seq > latestSeq {
+			latest, latestSeq = ln, seq
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+	return latest.Addr()
+}
+
+// vhostConfig is the virtual host configuration a server is running with,
+// swapped as a whole by SetVirtualHosts.
+type vhostConfig struct {
+	virtualHosts map[string]VirtualHost
+	certs        map[string]*tls.Certificate // by host name
+}
+
+// SetVirtualHosts replaces the virtual hosts of the server, e.g. with a
+// configuration reloaded by LoadVHConfigFile. It may be called while the
+// server is serving: requests already being handled finish with the old
+// virtual hosts, and later requests, including those on open keep-alive
+// connections, use the new ones. If vhosts is invalid, or a certificate
+// cannot be loaded, SetVirtualHosts returns an error and the server keeps
+// its current configuration. The caller must not modify vhosts afterwards.
+func (s *Server) SetVirtualHosts(vhosts map[string]VirtualHost) error {
+	c, err := newVHostConfig(vhosts)
+	if err != nil {
+		return err
+	}
+	s.vhosts.Store(c)
+	return nil
+}
+
+// initVirtualHosts checks VirtualHosts and makes it the current
+// configuration, unless the server already has one.
+func (s *Server) initVirtualHosts() error {
+	if s.vhosts.Load() != nil {
+		return nil
+	}
+	c, err := newVHostConfig(s.VirtualHosts)
+	if err != nil {
+		return err
+	}
+	// Keep a configuration set meanwhile by SetVirtualHosts or another Serve
+	s.vhosts.CompareAndSwap(nil, c)
+	return nil
+}
+
+// virtualHosts returns the current virtual host configuration.
+func (s *Server) virtualHosts() *vhostConfig {
+	if c := s.vhosts.Load(); c != nil {
+		return c
+	}
+	// Not serving yet, e.g. HandleConnection called directly
+	return &vhostConfig{virtualHosts: s.VirtualHosts}
+}
+
+// newVHostConfig checks vhosts and loads their certificates.
+func newVHostConfig(vhosts map[string]VirtualHost) (*vhostConfig, error) {
+	certs, err := validateVirtualHosts(vhosts)
+	if err != nil {
+		return nil, err
+	}
+	return &vhostConfig{virtualHosts: vhosts, certs: certs}, nil
+}
+
+// validateVirtualHosts checks that every virtual host's docRoot is an
+// existing directory and that its options are valid. The error is a
+// *ConfigError listing every problem. It returns the certificates of the
+// virtual hosts that have one, by host name.
+func validateVirtualHosts(vhosts map[string]VirtualHost) (map[string]*tls.Certificate, error) {
+	configErr := &ConfigError{}
+	certs := make(map[string]*tls.Certificate)
+	for _, hostName := range sortedKeys(vhosts) {
+		vhost := vhosts[hostName]
+		if vhost.HostName == "" {
+			// Maps built in code may leave the name to the key
+			vhost.HostName = hostName
+		}
+		cert, errs := vhost.validate()
+		for _, err := range errs {
+			configErr.add(-1, hostName, err)
+		}
+		if cert != nil {
+			certs[hostName] = cert
+		}
+	}
+	if len(configErr.Problems) > 0 {
+		return nil, configErr
+	}
+	return certs, nil
+}
+
+// Shutdown gracefully shuts down the server. It first closes all open
+// listeners, then closes all idle connections, and then waits for active
+// connections to finish their current response and close. If ctx expires
+// before that, Shutdown returns the context's error; the remaining
+// connections are left to finish on their own.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	for ln := range s.listeners {
+		if err := ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			s.logger().Warn("Failed to close listener", "err", err)
+		}
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) readTimeout() time.Duration {
+	if s.ReadTimeout > 0 {
+		return s.ReadTimeout
+	}
+	return READ_TIMEOUT
+}
+
+func (s *Server) readHeaderTimeout() time.Duration {
+	if s.ReadHeaderTimeout > 0 {
+		return s.ReadHeaderTimeout
+	}
+	return READ_HEADER_TIMEOUT
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return s.readTimeout()
+}
+
+// logger returns the logger of s.
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+// trackListener adds or removes ln from the set of listeners closed by
+// Shutdown. It reports false if ln cannot be added because the server is
+// already shutting down.
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]uint64)
+	}
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.listenSeq++
+		s.listeners[ln] = s.listenSeq
+	} else {
+		delete(s.listeners, ln)
+	}
+	return true
+}
+
+// trackConn records the state of conn. It reports false if conn went idle
+// after Shutdown was called, or if closeIdleConns closed it before it could
+// become active; either way the caller should close it.
+func (s *Server) trackConn(conn net.Conn, state connState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.activeConn == nil {
+		s.activeConn = make(map[net.Conn]connState)
+	}
+	if state == stateIdle && s.shuttingDown() {
+		return false
+	}
+	old, tracked := s.activeConn[conn]
+	if state == stateActive && !tracked {
+		return false
+	}
+	if tracked {
+		s.Metrics.addConns(old, -1)
+	}
+	s.activeConn[conn] = state
+	s.Metrics.addConns(state, 1)
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.activeConn[conn]; ok {
+		s.Metrics.addConns(state, -1)
+		delete(s.activeConn, conn)
+	}
+}
+
+// closeIdleConns closes all idle connections and reports whether the
+// server is quiescent, i.e. no connections are left.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, state := range s.activeConn {
+		if state == stateIdle {
+			conn.Close()
+			s.Metrics.addConns(state, -1)
+			delete(s.activeConn, conn)
+		}
+	}
+	return len(s.activeConn) == 0
+}
+
+// closeConn closes conn and stops tracking it.
+func (s *Server) closeConn(conn net.Conn, logger *slog.Logger) {
+	logger.Debug("Closing connection")
+	conn.Close()
+	s.untrackConn(conn)
+}
+
 // HandleConnection reads requests from the accepted conn and handles them.
+// Framing and keep-alive are handled here; the response itself comes from
+// the server's Handler.
 func (s *Server) HandleConnection(conn net.Conn) {
 	br := bufio.NewReader(conn)
+	handler := s.handler()
+	tlsConn, isTLS := conn.(*tls.Conn)
+	if !isTLS && s.RedirectToHTTPS {
+		handler = HandlerFunc(s.redirectToHTTPS)
+	}
+	connLogger := s.logger().With("conn", s.lastConnID.Add(1), "remote", remoteAddr(conn))
+	connLogger.Debug("Accepted connection")
+	s.Metrics.connAccepted()
 
 	// Continuously read from  connection until EOF or timeout
-	for {
+	for seq := 1; ; seq++ {
+		// Wait for the next request, which Shutdown may interrupt while idle
+		if !s.trackConn(conn, stateIdle) {
+			s.closeConn(conn, connLogger)
+			return
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(s.idleTimeout())); err != nil {
+			connLogger.Warn("Failed to set read deadline", "err", err)
+			s.closeConn(conn, connLogger)
+			return
+		}
+		if _, err := br.Peek(1); err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				s.Metrics.timeout("idle")
+			}
+			connLogger.Debug("Connection ended while idle", "err", err)
+			s.closeConn(conn, connLogger)
+			return
+		}
+		// A request has started arriving, unless Shutdown closed the
+		// connection as idle in the meantime
+		if !s.trackConn(conn, stateActive) {
+			s.closeConn(conn, connLogger)
+			return
+		}
+		start := time.Now()
+		logger := connLogger.With("req", seq)
+
 		// Read next request from the client
-		req, bytesRead, err := ReadRequest(conn, br)
+		req, bytesRead, err := readRequest(conn, br, logger, s.readTimeout(), s.readHeaderTimeout())
+
+		// The response, whichever it is, must be written in time
+		if s.WriteTimeout > 0 {
+			if err := conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout)); err != nil {
+				logger.Warn("Failed to set write deadline", "err", err)
+				s.closeConn(conn, logger)
+				return
+			}
+		}
 
 		// Handle EOF
 		if errors.Is(err, io.EOF) {
-			log.Printf("Connection closed by %v", conn.RemoteAddr())
+			logger.Debug("Connection closed by client")
 			conn.Close()
+			s.untrackConn(conn)
 			return
 		}
 
 		// Handle Timeout
 		if err, ok := err.(net.Error); ok && err.Timeout() {
-			log.Printf("Connection to %v timed out after reading %v bytes", conn.RemoteAddr(), bytesRead)
+			logger.Debug("Connection timed out", "bytesRead", bytesRead)
+			s.Metrics.timeout("request")
 			if bytesRead > 0 {
-				res := NewResponse(s, req, StatusBadRequest)
+				res := NewResponse(req, StatusBadRequest)
 				res.Write(conn)
+				s.recordResponse(conn, req, res.StatusCode, int64(len(res.Body)), start)
 			}
-			log.Printf("Closing connection to %v", conn.RemoteAddr())
-			conn.Close()
+			s.closeConn(conn, logger)
 			return
 		}
 
-		// Handle the request which is not a GET and immediately close the connection and return
+		// Handle the malformed or unsupported request and immediately close the connection and return
 		if err != nil {
-			log.Printf("Handle bad request for error: %v", err)
-			res := NewResponse(s, req, StatusBadRequest)
+			logger.Info("Bad request", "err", err)
+			statusCode := StatusBadRequest
+			var se *statusError
+			if errors.As(err, &se) {
+				statusCode = se.StatusCode
+			}
+			s.Metrics.parseError(statusCode)
+			res := NewResponse(req, statusCode)
 			res.Write(conn)
-			log.Printf("Closing connection to %v", conn.RemoteAddr())
-			conn.Close()
+			s.recordResponse(conn, req, res.StatusCode, int64(len(res.Body)), start)
+			s.closeConn(conn, logger)
 			return
 		}
 
-		res := NewResponse(s, req, StatusOK)
-		err = res.Write(conn)
-		if err != nil {
-			log.Println(err)
+		if isTLS {
+			state := tlsConn.ConnectionState()
+			req.TLS = &state
 		}
 
-		if req.Close {
-			log.Printf("Closing connection to %v", conn.RemoteAddr())
-			conn.Close()
+		// Resolve the virtual host, whose error pages apply from here on.
+		// The configuration may be swapped between requests.
+		vhosts := s.virtualHosts().virtualHosts
+		if hostName, ok := lookupVirtualHost(vhosts, req.Host); ok {
+			vhost := vhosts[hostName]
+			vhost.HostName = hostName
+			req.VirtualHost = &vhost
+		}
+
+		// The client checked the certificate of the SNI name, not of Host
+		if misdirected(vhosts, req) {
+			logger.Info("Misdirected request", "serverName", req.TLS.ServerName, "host", req.Host)
+			s.refuseRequest(conn, req, StatusMisdirectedRequest, start)
+			return
+		}
+
+		if s.RejectEncodedSlashes && hasEncodedSlash(req.RawPath) {
+			logger.Info("Bad request: encoded slash in URL", "uri", req.RequestURI)
+			s.refuseRequest(conn, req, StatusBadRequest, start)
+			return
+		}
+
+		// Refuse bodies over the limit before the handler starts on them
+		var body *maxBytesReader
+		if s.MaxBodyBytes > 0 {
+			if req.ContentLength > s.MaxBodyBytes {
+				logger.Info("Refusing request body over the limit", "contentLength", req.ContentLength, "limit", s.MaxBodyBytes)
+				s.refuseRequest(conn, req, StatusPayloadTooLarge, start)
+				return
+			}
+			body = &maxBytesReader{r: req.Body, n: s.MaxBodyBytes}
+			req.Body = body
+		}
+
+		// Tell the client not to reuse the connection once we are shutting down
+		if s.shuttingDown() {
+			req.Close = true
+		}
+
+		// Let the handler respond
+		w := newResponseWriter(conn, req)
+		w.keepAlive = s.idleTimeout()
+		s.serveRequest(handler, w, req)
+		if body != nil && body.exceeded {
+			w.closeAfter = true
+			if !w.wroteHeader {
+				Error(w, req, StatusPayloadTooLarge)
+			}
+		}
+		if err := w.finish(); err != nil {
+			logger.Debug("Failed to finish response", "err", err)
+		}
+		s.recordResponse(conn, req, w.statusCode, w.written, start)
+
+		// Skip what the handler left of the body so the next request can be read
+		if !w.closeAfter {
+			n, err := io.Copy(io.Discard, io.LimitReader(req.Body, maxDrainBytes+1))
+			if err != nil || n > maxDrainBytes {
+				logger.Debug("Not reusing connection with unread request body", "err", err)
+				w.closeAfter = true
+			}
+		}
+
+		if w.closeAfter {
+			s.closeConn(conn, logger)
 			return
 		}
 		// We'll never close the connection and handle as many requests for this connection
 		// and pass on this responsibility to the timeout mechanism
 	}
 }
+
+// refuseRequest answers a parsed request that will not reach the handler
+// with an error response, and closes the connection since the rest of the
+// request is not read.
+func (s *Server) refuseRequest(conn net.Conn, req *Request, statusCode int, start time.Time) {
+	w := newResponseWriter(conn, req)
+	w.closeAfter = true
+	Error(w, req, statusCode)
+	if err := w.finish(); err != nil {
+		req.Logger().Debug("Failed to finish response", "err", err)
+	}
+	s.recordResponse(conn, req, w.statusCode, w.written, start)
+	s.closeConn(conn, req.Logger())
+}
+
+// recordResponse records a response in the metrics and the access log,
+// if the server has them. req is nil if the request could not be parsed.
+func (s *Server) recordResponse(conn net.Conn, req *Request, statusCode int, bytesSent int64, start time.Time) {
+	if s.Metrics == nil && s.AccessLog == nil {
+		return
+	}
+	entry := AccessLogEntry{
+		Time:      start,
+		Status:    statusCode,
+		BytesSent: bytesSent,
+		Duration:  time.Since(start),
+	}
+	entry.RemoteAddr = remoteAddr(conn)
+	if req != nil {
+		entry.Method = req.Method
+		entry.RequestURI = req.RequestURI
+		entry.Protocol = req.Protocol
+		entry.Host = req.Host
+		entry.Referer = req.Headers["Referer"]
+		entry.UserAgent = req.Headers["User-Agent"]
+		if req.VirtualHost != nil {
+			entry.VirtualHost = req.VirtualHost.HostName
+		}
+	}
+	s.Metrics.observeResponse(entry.VirtualHost, entry.Method, entry.Status, entry.BytesSent, entry.Duration)
+	if s.AccessLog != nil {
+		s.AccessLog.LogAccess(entry)
+	}
+}
+
+// remoteAddr returns the address of the peer of conn, or "" if unknown.
+func remoteAddr(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
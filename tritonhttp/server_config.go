@@ -0,0 +1,238 @@
+package tritonhttp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ServerConfig is the "server" section of the configuration file, which
+// holds the settings of tritonhttpd besides its virtual hosts. Each setting
+// can also be given by a command line flag or an environment variable,
+// which take precedence over the file.
+type ServerConfig struct {
+	// Port is the port to listen on for HTTP, on every interface.
+	Port int `yaml:"port"`
+
+	// Addr is the host:port address to listen on for HTTP, e.g.
+	// "127.0.0.1:8080". It overrides Port.
+	Addr string `yaml:"addr"`
+
+	// TLSPort is the port to listen on for HTTPS, or 0 to disable HTTPS.
+	TLSPort int `yaml:"tlsPort"`
+
+	// TLSAddr is the host:port address to listen on for HTTPS. It
+	// overrides TLSPort, and enables HTTPS even if TLSPort is 0.
+	TLSAddr string `yaml:"tlsAddr"`
+
+	// RedirectHTTPS redirects every plaintext request to HTTPS.
+	RedirectHTTPS bool `yaml:"redirectHTTPS"`
+
+	// Docroot is the directory that contains the docRoot of every virtual
+	// host. Relative paths in the file are relative to the file.
+	Docroot string `yaml:"docroot"`
+
+	// MetricsAddr is the admin address to serve metrics on, or "" to
+	// disable metrics.
+	MetricsAddr string `yaml:"metricsAddr"`
+
+	// WatchInterval is how often to check the configuration file for
+	// changes, or 0 to reload it only on SIGHUP.
+	WatchInterval time.Duration `yaml:"watchInterval"`
+
+	Timeouts TimeoutConfig `yaml:"timeouts"`
+	Limits   LimitConfig   `yaml:"limits"`
+	Log      LogConfig     `yaml:"log"`
+}
+
+// TimeoutConfig holds the timeouts of the server; see the fields of Server
+// of the same names.
+type TimeoutConfig struct {
+	Read       time.Duration `yaml:"read"`
+	ReadHeader time.Duration `yaml:"readHeader"`
+	Write      time.Duration `yaml:"write"`
+	Idle       time.Duration `yaml:"idle"`
+
+	// Shutdown is how long to wait for open connections on shutdown.
+	Shutdown time.Duration `yaml:"shutdown"`
+}
+
+// LimitConfig holds the limits on requests; see the fields of Server of the
+// same names.
+type LimitConfig struct {
+	MaxBodyBytes         int64 `yaml:"maxBodyBytes"`
+	RejectEncodedSlashes bool  `yaml:"rejectEncodedSlashes"`
+}
+
+// LogConfig configures the server log and the access log.
+type LogConfig struct {
+	// Level is the minimum level of server logs: debug, info, warn or error.
+	Level string `yaml:"level"`
+
+	// Format is the format of server logs: text or json.
+	Format string `yaml:"format"`
+
+	// AccessLog is the path to the access log, "-" for stdout, or "" for
+	// none. Relative paths in the file are relative to the file.
+	AccessLog string `yaml:"accessLog"`
+
+	AccessLogFormat     AccessLogFormat `yaml:"accessLogFormat"`
+	AccessLogMaxSize    int64           `yaml:"accessLogMaxSize"`
+	AccessLogMaxBackups int             `yaml:"accessLogMaxBackups"`
+}
+
+// ListenAddr returns the address to listen on for HTTP: Addr, or else Port
+// on every interface.
+func (c ServerConfig) ListenAddr() string {
+	if c.Addr != "" {
+		return c.Addr
+	}
+	return fmt.Sprintf(":%v", c.Port)
+}
+
+// TLSListenAddr returns the address to listen on for HTTPS: TLSAddr, or
+// else TLSPort on every interface, or "" if HTTPS is disabled.
+func (c ServerConfig) TLSListenAddr() string {
+	if c.TLSAddr != "" {
+		return c.TLSAddr
+	}
+	if c.TLSPort != 0 {
+		return fmt.Sprintf(":%v", c.TLSPort)
+	}
+	return ""
+}
+
+// LoadServerConfig reads the "server" section of the configuration file at
+// path into config. Settings missing from the file keep their value in
+// config, so config should hold the defaults. The virtual hosts are left to
+// LoadVHConfigFile. A missing file leaves config unchanged.
+func LoadServerConfig(path string, config *ServerConfig) error {
+	f, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file %s: %w", path, err)
+	}
+
+	docroot, accessLog := config.Docroot, config.Log.AccessLog
+	file := struct {
+		Server       *ServerConfig `yaml:"server"`
+		VirtualHosts interface{}   `yaml:"virtual_hosts"`
+	}{Server: config}
+	if err := yaml.UnmarshalStrict(f, &file); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return fmt.Errorf("failed to unmarshal YAML in %s: %w", path, err)
+		}
+		configErr := &ConfigError{Path: path}
+		for _, msg := range typeErr.Errors {
+			configErr.add(-1, "", errors.New(msg))
+		}
+		return configErr
+	}
+
+	// Paths from the file are relative to the file
+	if config.Docroot != docroot && config.Docroot != "" {
+		config.Docroot = resolveConfigPath(path, config.Docroot)
+	}
+	if config.Log.AccessLog != accessLog && config.Log.AccessLog != "" && config.Log.AccessLog != "-" {
+		config.Log.AccessLog = resolveConfigPath(path, config.Log.AccessLog)
+	}
+	return nil
+}
+
+// Validate returns a *ConfigError listing every invalid setting of c, or nil.
+func (c ServerConfig) Validate() error {
+	configErr := &ConfigError{}
+	problem := func(format string, args ...any) {
+		configErr.add(-1, "", fmt.Errorf("server: "+format, args...))
+	}
+
+	if c.Port < 0 || c.Port > 65535 {
+		problem("port %v is out of range", c.Port)
+	}
+	if c.TLSPort < 0 || c.TLSPort > 65535 {
+		problem("tlsPort %v is out of range", c.TLSPort)
+	}
+	addrs := []struct {
+		name string
+		addr string
+	}{
+		{"addr", c.Addr},
+		{"tlsAddr", c.TLSAddr},
+	}
+	for _, a := range addrs {
+		if a.addr == "" {
+			continue
+		}
+		if err := validListenAddr(a.addr); err != nil {
+			problem("invalid %v %q: %v", a.name, a.addr, err)
+		}
+	}
+	if c.RedirectHTTPS && c.TLSListenAddr() == "" {
+		problem("redirectHTTPS needs tlsPort or tlsAddr")
+	}
+	if c.WatchInterval < 0 {
+		problem("negative watchInterval %v", c.WatchInterval)
+	}
+	timeouts := []struct {
+		name    string
+		timeout time.Duration
+	}{
+		{"read", c.Timeouts.Read},
+		{"readHeader", c.Timeouts.ReadHeader},
+		{"write", c.Timeouts.Write},
+		{"idle", c.Timeouts.Idle},
+		{"shutdown", c.Timeouts.Shutdown},
+	}
+	for _, t := range timeouts {
+		if t.timeout < 0 {
+			problem("negative %v timeout %v", t.name, t.timeout)
+		}
+	}
+	if c.Limits.MaxBodyBytes < 0 {
+		problem("negative maxBodyBytes %v", c.Limits.MaxBodyBytes)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		problem("invalid log level %q", c.Log.Level)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		problem("unknown log format %q", c.Log.Format)
+	}
+	if !c.Log.AccessLogFormat.valid() {
+		problem("unknown access log format %q", c.Log.AccessLogFormat)
+	}
+	if c.Log.AccessLogMaxSize < 0 {
+		problem("negative accessLogMaxSize %v", c.Log.AccessLogMaxSize)
+	}
+	if c.Log.AccessLogMaxBackups < 0 {
+		problem("negative accessLogMaxBackups %v", c.Log.AccessLogMaxBackups)
+	}
+
+	if len(configErr.Problems) > 0 {
+		return configErr
+	}
+	return nil
+}
+
+// validListenAddr checks that addr is a host:port address with a port
+// number, where the host may be empty for every interface.
+func validListenAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
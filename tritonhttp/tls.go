@@ -0,0 +1,165 @@
+package tritonhttp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// selfSignedValidity is how long certificates from GenerateSelfSignedCert
+// are valid.
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// ListenAndServeTLS listens on the TCP network address s.TLSAddr and then
+// handles HTTPS requests on incoming connections, with the certificates of
+// the virtual hosts. It always returns a non-nil error; after Shutdown the
+// returned error is ErrServerClosed.
+func (s *Server) ListenAndServeTLS() error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+
+	ln, err := net.Listen(TCP, s.TLSAddr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(ln)
+}
+
+// ServeTLS is like Serve, but performs a TLS handshake on each accepted
+// connection first. The certificate is chosen by the server name the client
+// sends (SNI), among the CertFile and KeyFile of the virtual hosts.
+func (s *Server) ServeTLS(ln net.Listener) error {
+	if err := s.initVirtualHosts(); err != nil {
+		ln.Close()
+		return err
+	}
+	config, err := s.tlsConfig()
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	return s.Serve(tls.NewListener(ln, config))
+}
+
+// tlsConfig returns a configuration, based on s.TLSConfig, that picks the
+// certificate of a virtual host by SNI. The certificates are those of the
+// configuration current at the time of each handshake.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if s.TLSConfig != nil {
+		config = s.TLSConfig.Clone()
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+	if config.GetCertificate != nil || len(config.Certificates) > 0 {
+		return config, nil
+	}
+	if len(s.virtualHosts().certs) == 0 {
+		return nil, errors.New("no virtual host has a certificate")
+	}
+
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		c := s.virtualHosts()
+		if hostName, ok := lookupVirtualHost(c.virtualHosts, hello.ServerName); ok {
+			if cert, ok := c.certs[hostName]; ok {
+				return cert, nil
+			}
+		}
+		// Clients that send no server name, or one whose virtual host has
+		// no certificate, get the certificate of the default virtual host
+		if cert, ok := c.certs[DefaultVirtualHost]; ok {
+			return cert, nil
+		}
+		return nil, fmt.Errorf("no certificate for server name %q", hello.ServerName)
+	}
+	return config, nil
+}
+
+// misdirected reports whether a request over TLS is for another virtual
+// host than the one named by SNI, whose certificate the client checked.
+func misdirected(vhosts map[string]VirtualHost, req *Request) bool {
+	if req.TLS == nil || req.TLS.ServerName == "" {
+		return false
+	}
+	sniHost, sniOK := lookupVirtualHost(vhosts, req.TLS.ServerName)
+	host, hostOK := lookupVirtualHost(vhosts, req.Host)
+	return sniOK != hostOK || sniHost != host
+}
+
+// redirectToHTTPS is the handler of plaintext connections when
+// RedirectToHTTPS is set. It redirects every request to the same URL on the
+// HTTPS address of the server.
+func (s *Server) redirectToHTTPS(w ResponseWriter, r *Request) {
+	host := stripHostPort(r.Host)
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if _, port, err := net.SplitHostPort(s.TLSAddr); err == nil && port != "443" && port != "" {
+		host += ":" + port
+	}
+	location := "https://" + host + "/" + strings.TrimLeft(r.RawPath, "/")
+	if r.RawQuery != "" {
+		location += "?" + r.RawQuery
+	}
+	Redirect(w, r, location, StatusMovedPermanently)
+}
+
+// GenerateSelfSignedCert returns a PEM encoded certificate and private key
+// for the given host names and IP addresses, signed by the key itself. It
+// lets tests and local setups serve HTTPS without a certificate authority.
+func GenerateSelfSignedCert(hosts ...string) (certPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"TritonHTTP self-signed"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
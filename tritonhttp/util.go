@@ -25,3 +25,24 @@ func FormatTime(t time.Time) string {
 	s = s[:len(s)-3] + "GMT"
 	return s
 }
+
+// timeFormats are the date formats a client may use in HTTP headers such
+// as "If-Modified-Since": the preferred IMF-fixdate and the obsolete RFC 850
+// and ANSI C asctime() formats.
+var timeFormats = []string{
+	"Mon, 02 Jan 2006 15:04:05 GMT",
+	time.RFC850,
+	time.ANSIC,
+}
+
+// ParseTime parses a time header (such as "If-Modified-Since") in any of
+// the three formats allowed by HTTP/1.1.
+func ParseTime(text string) (t time.Time, err error) {
+	for _, layout := range timeFormats {
+		t, err = time.Parse(layout, text)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return t, err
+}
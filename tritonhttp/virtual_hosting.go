@@ -1,50 +1,379 @@
 package tritonhttp
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
+	"math"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
 
 // VHConfigs is a struct to hold the virtual host configuration
 type VHConfigs struct {
-	VirtualHosts []struct {
-		HostName string `yaml:"hostName"`
-		DocRoot  string `yaml:"docRoot"`
-	} `yaml:"virtual_hosts"`
+	// Server is read by LoadServerConfig
+	Server       ServerConfig  `yaml:"server"`
+	VirtualHosts []VirtualHost `yaml:"virtual_hosts"`
+}
+
+// VirtualHost is the configuration of a single virtual host.
+type VirtualHost struct {
+	// HostName is the name matched against the Host header, e.g. "website1"
+	HostName string `yaml:"hostName"`
+
+	// DocRoot is the path to the directory to serve static files from
+	DocRoot string `yaml:"docRoot"`
+
+	// Symlinks controls whether symbolic links under DocRoot are followed.
+	// The zero value follows them.
+	Symlinks SymlinkPolicy `yaml:"symlinks"`
+
+	// Compression configures on-the-fly compression of static files.
+	Compression CompressionConfig `yaml:"compression"`
+
+	// IndexFiles lists the files served for a directory, in order of
+	// preference. Empty means defaultIndexFiles.
+	IndexFiles []string `yaml:"indexFiles,omitempty"`
+
+	// AutoIndex configures listings of directories without an index file.
+	AutoIndex AutoIndexConfig `yaml:"autoIndex"`
+
+	// ErrorPages maps status codes to the URL paths of error documents
+	// under DocRoot, e.g. 404: "/errors/404.html". Other errors get a
+	// built-in page.
+	ErrorPages map[int]string `yaml:"errorPages,omitempty"`
+
+	// MIME configures the Content-Type of static files.
+	MIME MIMEConfig `yaml:"mime"`
+
+	// Headers are added to every response of the virtual host, e.g.
+	// "Strict-Transport-Security": "max-age=31536000". Handlers may
+	// override them.
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// Caching configures the Cache-Control header of static files.
+	Caching CachingConfig `yaml:"caching"`
+
+	// CertFile and KeyFile are the PEM encoded certificate chain and private
+	// key served over HTTPS to clients asking for this host by SNI. Relative
+	// paths are relative to the configuration file.
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+// defaultIndexFiles are the index files of a virtual host without IndexFiles.
+var defaultIndexFiles = []string{"index.html"}
+
+func (vh VirtualHost) indexFiles() []string {
+	if len(vh.IndexFiles) == 0 {
+		return defaultIndexFiles
+	}
+	return vh.IndexFiles
+}
+
+// validIndexFile reports whether name can be used as an index file, which
+// must be a plain file name inside the directory.
+func validIndexFile(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// reservedHeaders are set by the server to frame the response and manage
+// the connection, so a virtual host may not configure them.
+var reservedHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Keep-Alive":        true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// validHeaders checks the names and values of the headers of a virtual host.
+func validHeaders(headers map[string]string) error {
+	for _, key := range sortedKeys(headers) {
+		if !validHTTPToken(key) {
+			return fmt.Errorf("invalid header name %q", key)
+		}
+		if reservedHeaders[CanonicalHeaderKey(key)] {
+			return fmt.Errorf("header %v is set by the server", CanonicalHeaderKey(key))
+		}
+		if strings.ContainsAny(headers[key], "\r\n\x00") {
+			return fmt.Errorf("invalid value for header %v", key)
+		}
+	}
+	return nil
 }
 
 // ParseVHConfigFile parses the virtual host configuration file (YAML) and returns a map
-// of virtual hosts to their docroot paths.
-func ParseVHConfigFile(vhConfigFilePath string, docrootDirsPath string) map[string]string {
+// of virtual host names to their configuration, with docroot paths joined to docrootDirsPath.
+// It exits the program if the configuration is invalid; see LoadVHConfigFile.
+func ParseVHConfigFile(vhConfigFilePath string, docrootDirsPath string) map[string]VirtualHost {
+	vhMap, err := LoadVHConfigFile(vhConfigFilePath, docrootDirsPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return vhMap
+}
+
+// LoadVHConfigFile is like ParseVHConfigFile, but returns an error if the
+// configuration cannot be read or is invalid, so that it can be used by a
+// running server or by tests. If the file is readable YAML, the error is a
+// *ConfigError listing every problem found in it.
+func LoadVHConfigFile(vhConfigFilePath string, docrootDirsPath string) (map[string]VirtualHost, error) {
 	// Read the YAML file
 	f, err := os.ReadFile(vhConfigFilePath)
 	if err != nil {
-		log.Fatalf("Failed to read configuration file %s: %v", vhConfigFilePath, err)
+		return nil, fmt.Errorf("failed to read configuration file %s: %w", vhConfigFilePath, err)
 	}
 
-	// Unmarshal the YAML file
+	// Unmarshal the YAML file, rejecting unknown and duplicate keys. Type
+	// errors leave the rest of the file decoded, so they are reported along
+	// with the other problems.
+	configErr := &ConfigError{Path: vhConfigFilePath}
 	vhostConfigs := VHConfigs{}
-	if yaml.Unmarshal(f, &vhostConfigs) != nil {
-		log.Fatalf("Failed to unmarshal YAML: %v", err)
+	if err := yaml.UnmarshalStrict(f, &vhostConfigs); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("failed to unmarshal YAML in %s: %w", vhConfigFilePath, err)
+		}
+		for _, msg := range typeErr.Errors {
+			configErr.add(-1, "", errors.New(msg))
+		}
 	}
 
 	// Iterate through the virtual hosts and construct the map
-	vhMap := make(map[string]string)
-	for _, vhost := range vhostConfigs.VirtualHosts {
-		docrootPath := filepath.Join(docrootDirsPath, vhost.DocRoot)
+	vhMap := make(map[string]VirtualHost)
+	seen := make(map[string]int)
+	for i, vhost := range vhostConfigs.VirtualHosts {
+		vhost.DocRoot = filepath.Join(docrootDirsPath, vhost.DocRoot)
 
-		// Check if the path exists
-		_, err := os.Stat(docrootPath)
-		if err != nil {
-			log.Fatalf("Docroot %s does not exist: %v", docrootPath, err)
+		// Certificate paths are relative to the config file
+		if vhost.CertFile != "" {
+			vhost.CertFile = resolveConfigPath(vhConfigFilePath, vhost.CertFile)
+		}
+		if vhost.KeyFile != "" {
+			vhost.KeyFile = resolveConfigPath(vhConfigFilePath, vhost.KeyFile)
+		}
+
+		// Host names match case-insensitively, so they must differ in more
+		// than case
+		if vhost.HostName != "" {
+			if first, ok := seen[strings.ToLower(vhost.HostName)]; ok {
+				configErr.add(i, vhost.HostName, fmt.Errorf("duplicate hostName, already used by virtual host %d", first))
+			} else {
+				seen[strings.ToLower(vhost.HostName)] = i
+			}
+		}
+
+		_, errs := vhost.validate()
+		for _, err := range errs {
+			configErr.add(i, vhost.HostName, err)
 		}
 
 		// Add the virtual host to the map
-		vhMap[vhost.HostName] = docrootPath
+		vhMap[vhost.HostName] = vhost
 	}
 
-	return vhMap
+	if len(configErr.Problems) > 0 {
+		return nil, configErr
+	}
+	return vhMap, nil
+}
+
+// validate returns every problem with the configuration of vh: a missing
+// host name or docroot, and invalid options. It also returns the certificate
+// of vh, loaded while checking it, or nil if vh has none or it is invalid.
+func (vh VirtualHost) validate() (cert *tls.Certificate, errs []error) {
+	if vh.HostName == "" {
+		errs = append(errs, errors.New("empty hostName"))
+	}
+
+	// Check that the docroot is an existing directory
+	if vh.DocRoot == "" {
+		errs = append(errs, errors.New("empty docRoot"))
+	} else if fileInfo, err := os.Stat(vh.DocRoot); err != nil {
+		errs = append(errs, fmt.Errorf("docroot %s does not exist: %w", vh.DocRoot, err))
+	} else if !fileInfo.IsDir() {
+		errs = append(errs, fmt.Errorf("docroot %s is not a directory", vh.DocRoot))
+	}
+
+	// Check the symlink policy
+	if !vh.Symlinks.valid() {
+		errs = append(errs, fmt.Errorf("invalid symlinks policy %q", vh.Symlinks))
+	}
+
+	// Check the compression settings
+	if err := vh.Compression.valid(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid compression settings: %w", err))
+	}
+
+	// Check the index files
+	for _, name := range vh.IndexFiles {
+		if !validIndexFile(name) {
+			errs = append(errs, fmt.Errorf("invalid index file %q", name))
+		}
+	}
+
+	// Check the error pages
+	if err := validErrorPages(vh.ErrorPages); err != nil {
+		errs = append(errs, fmt.Errorf("invalid errorPages: %w", err))
+	}
+
+	// Check the media types
+	if err := vh.MIME.valid(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid mime settings: %w", err))
+	}
+
+	// Check the directory listing settings
+	if err := vh.AutoIndex.valid(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid autoIndex settings: %w", err))
+	}
+
+	// Check the response headers
+	if err := validHeaders(vh.Headers); err != nil {
+		errs = append(errs, fmt.Errorf("invalid headers: %w", err))
+	}
+
+	// Check the caching settings
+	if err := vh.Caching.valid(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid caching settings: %w", err))
+	}
+
+	// Check the certificate
+	if (vh.CertFile == "") != (vh.KeyFile == "") {
+		errs = append(errs, errors.New("needs both certFile and keyFile"))
+	} else if vh.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(vh.CertFile, vh.KeyFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid certificate: %w", err))
+		} else {
+			cert = &pair
+		}
+	}
+
+	return cert, errs
+}
+
+// A ConfigProblem is one problem found in a configuration file.
+type ConfigProblem struct {
+	// Index is the position of the virtual host in the file, from 0, or -1
+	// if the problem is not about one virtual host.
+	Index int
+
+	// HostName is the hostName of the virtual host, if it has one.
+	HostName string
+
+	Err error
+}
+
+func (p ConfigProblem) Error() string {
+	switch {
+	case p.HostName != "":
+		return fmt.Sprintf("virtual host %q: %v", p.HostName, p.Err)
+	case p.Index >= 0:
+		return fmt.Sprintf("virtual host %d: %v", p.Index, p.Err)
+	}
+	return p.Err.Error()
+}
+
+func (p ConfigProblem) Unwrap() error {
+	return p.Err
+}
+
+// A ConfigError lists every problem found in a configuration file.
+type ConfigError struct {
+	Path     string // the configuration file, or "" if not loaded from a file
+	Problems []ConfigProblem
+}
+
+func (e *ConfigError) add(index int, hostName string, err error) {
+	e.Problems = append(e.Problems, ConfigProblem{Index: index, HostName: hostName, Err: err})
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	if e.Path != "" {
+		b.WriteString(e.Path + ": ")
+	}
+	if len(e.Problems) == 1 {
+		b.WriteString(e.Problems[0].Error())
+		return b.String()
+	}
+	fmt.Fprintf(&b, "%d problems in configuration:", len(e.Problems))
+	for _, p := range e.Problems {
+		b.WriteString("\n  " + p.Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns the problems, for errors.Is and errors.As.
+func (e *ConfigError) Unwrap() []error {
+	errs := make([]error, len(e.Problems))
+	for i, p := range e.Problems {
+		errs[i] = p
+	}
+	return errs
+}
+
+// resolveConfigPath returns path, if relative, joined to the directory of
+// the configuration file at configPath.
+func resolveConfigPath(configPath string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(configPath), path)
+}
+
+// DefaultVirtualHost is the host name that matches any Host header no other
+// virtual host matches.
+const DefaultVirtualHost = "*"
+
+// stripHostPort removes the port and any IPv6 brackets or trailing root dot
+// from the value of a Host header.
+func stripHostPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.TrimSuffix(host, ".")
+}
+
+// matchHostName reports whether host matches the virtual host name pattern.
+// Matching is case-insensitive. A pattern "*.example.test" matches any
+// subdomain of example.test (but not example.test itself), and the pattern
+// "*" matches every host. A higher score means a more specific match.
+func matchHostName(pattern string, host string) (score int, ok bool) {
+	switch {
+	case pattern == DefaultVirtualHost:
+		return 0, true
+	case strings.HasPrefix(pattern, "*."):
+		suffix := pattern[1:]
+		if len(host) > len(suffix) && strings.EqualFold(host[len(host)-len(suffix):], suffix) {
+			return len(suffix), true
+		}
+		return 0, false
+	default:
+		// Exact names beat any wildcard
+		return math.MaxInt, strings.EqualFold(pattern, host)
+	}
+}
+
+// lookupVirtualHost finds the virtual host serving the given Host header
+// value and returns its host name as configured. An exact host name wins over
+// wildcards, a longer wildcard over a shorter one, and the default virtual
+// host "*" is used only when nothing else matches.
+func lookupVirtualHost(virtualHosts map[string]VirtualHost, host string) (string, bool) {
+	host = stripHostPort(host)
+	best, bestScore, found := "", -1, false
+	for pattern := range virtualHosts {
+		if score, ok := matchHostName(pattern, host); ok && score > bestScore {
+			best, bestScore, found = pattern, score, true
+		}
+	}
+	return best, found
 }